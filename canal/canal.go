@@ -1,10 +1,10 @@
 package canal
 
 import (
+	"github.com/enustah/db-canal/config"
 	"github.com/enustah/db-canal/hook"
 	"github.com/enustah/db-canal/register"
 	"github.com/enustah/db-canal/util"
-	"github.com/kr/pretty"
 	"strings"
 )
 
@@ -19,25 +19,40 @@ type CanalBuilder interface {
 	GetCanal() (Canal, error)
 }
 
+// ParseHookChain parse hook chain of string form
 func ParseHookChain(s []string) (hook.HookChain, error) {
-	hookChain := hook.HookChain{}
+	c := make([]config.HookConfig, 0, len(s))
 	for _, v := range s {
-		h, args, err := parseHook(v)
-		if err != nil {
-			util.GetLog().WithField("hook", v).
-				WithField("error", err).
-				Errorf("hook parse fail")
-			return hook.HookChain{}, err
+		c = append(c, config.HookConfig{Str: v})
+	}
+	return ParseHookConfig(c)
+}
+
+// ParseHookConfig parse hook chain of string form or structured form
+func ParseHookConfig(c []config.HookConfig) (hook.HookChain, error) {
+	hookChain := hook.HookChain{}
+	for _, v := range c {
+		var (
+			h    *hook.Hook
+			args []string
+			err  error
+		)
+		if v.Name == "" {
+			h, args, err = parseHook(v.Str)
+			if err == nil {
+				err = hookChain.AppendHook(h, args)
+			}
+		} else if h, err = register.RegisterGetHook(v.Name); err == nil {
+			err = hookChain.AppendHookArgs(h, v.Args, v.NamedArgs)
 		}
-		if err = hookChain.AppendHook(h, args); err != nil {
-			util.GetLog().WithField("hook", v).
+		if err != nil {
+			util.GetLog().WithField("hook", v.String()).
 				WithField("error", err).
 				Errorf("hook parse fail")
 			return hook.HookChain{}, err
 		}
-		util.GetLog().WithField("hook", v).
-			WithField("args", pretty.Sprint(args)).
-			Debugf("hook parse done, args")
+		util.GetLog().WithField("hook", v.String()).
+			Debugf("hook parse done")
 	}
 	return hookChain, nil
 }
@@ -55,7 +70,7 @@ func parseHook(s string) (h *hook.Hook, args []string, err error) {
 		return nil, nil, err
 	}
 	if argsStr != "" {
-		args = strings.Split(argsStr, ",")
+		args = hook.SplitArgs(argsStr)
 	}
 	return h, args, nil
 }
@@ -64,9 +64,20 @@ func (m *MultiCanalBuilder) BuildInput() {
 		if m.err = ingressDriver.Init(m.config.Ingress); m.err != nil {
 			return
 		}
+
+		util.GetLog().WithField("canal", m.config.CanalConfig.Name).
+			WithField("driver", m.config.Ingress.Driver).
+			WithField("hookChain", pretty.Sprint(m.config.Ingress.HookChain)).
+			Debugf("multi canal init input parse HookChain")
+
+		var hookChain hook.HookChain
+		if hookChain, m.err = canal.ParseHookConfig(m.config.Ingress.HookChain); m.err != nil {
+			return
+		}
 		m.canal.input = &input{
 			ingressDriver: ingressDriver,
 			driverName:    m.config.Ingress.Driver,
+			hook:          hookChain,
 		}
 	}
 }
@@ -96,7 +107,7 @@ func (m *MultiCanalBuilder) BuildOutput() {
 				WithField("hookChain", pretty.Sprint(v.HookChain)).
 				Debugf("multi canal init egress parse HookChain")
 
-			if hookChain, m.err = canal.ParseHookChain(v.HookChain); m.err != nil {
+			if hookChain, m.err = canal.ParseHookConfig(v.HookChain); m.err != nil {
 				return
 			}
 			outputs = append(outputs, &output{
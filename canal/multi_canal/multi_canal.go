@@ -18,6 +18,8 @@ import (
 type input struct {
 	driverName    string
 	ingressDriver driver.IngressDriver
+	// run once on data batch before copy to all output
+	hook hook.HookChain
 }
 
 func (i input) String() string {
@@ -182,21 +184,12 @@ func (m *MultiCanal) mainLoop(ch <-chan *driver.Data) {
 
 	for {
 		var (
-			// dataBatch for each output
-			dataBatch      = make([][]*driver.Data, len(m.output)) // [output][dataBatch]
-			count     uint = 0
-			lastData  *driver.Data
-			// append data will copy the data to all output
-			appendData = func(data *driver.Data) {
-				for i, _ := range dataBatch {
-					dataBatch[i] = append(dataBatch[i], data.DeepCopy())
-				}
-			}
+			// dataBatch from input, copy to each output after input hook chain
+			inputBatch      = make([]*driver.Data, 0, m.maxDataBatch)
+			dataBatch       = make([][]*driver.Data, len(m.output)) // [output][dataBatch]
+			count      uint = 0
+			lastData   *driver.Data
 		)
-		// init dataBatch for all output
-		for i, _ := range dataBatch {
-			dataBatch[i] = make([]*driver.Data, 0, m.maxDataBatch)
-		}
 
 		// init timer
 		var timer <-chan time.Time = nil // nil channel will always block
@@ -229,7 +222,7 @@ func (m *MultiCanal) mainLoop(ch <-chan *driver.Data) {
 					}
 					count++
 					lastData = data
-					appendData(data)
+					inputBatch = append(inputBatch, data)
 					if count >= m.maxDataBatch { // reach max data batch
 						break dataLoop
 					}
@@ -237,9 +230,45 @@ func (m *MultiCanal) mainLoop(ch <-chan *driver.Data) {
 			}
 		}
 
-		m.log().WithField("dataBatch len", len(dataBatch[0])).
-			WithField("data", pretty.Sprint(dataBatch[0])).
+		m.log().WithField("dataBatch len", len(inputBatch)).
+			WithField("data", pretty.Sprint(inputBatch)).
 			Debugf("canal get data batch")
+
+		// pass input hook chain, err is not nil only when ctx cancel.
+		// the rows of an event share the table and database, copy them so the hooks modify each row alone,
+		// and every retry start from the origin data. skip it when input has no hook
+		hookBatch := inputBatch
+		inputHook := m.input.hook.Len() != 0
+		if inputHook {
+			if err := m.backoffDo(func() error {
+				var err error
+				hookBatch = make([]*driver.Data, 0, len(inputBatch))
+				for _, v := range inputBatch {
+					hookBatch = append(hookBatch, v.DeepCopy())
+				}
+				hookBatch, err = m.input.hook.PassThrough(hookBatch)
+				if err != nil {
+					m.log().WithField("input", m.input.driverName).
+						WithField("error", err).
+						Errorf("input hook run fail")
+				}
+				return err
+			}); err != nil {
+				return
+			}
+		}
+		// copy data to all output, the last output use the data copied by input hook
+		for i := range dataBatch {
+			if i == len(dataBatch)-1 && inputHook {
+				dataBatch[i] = hookBatch
+				break
+			}
+			dataBatch[i] = make([]*driver.Data, 0, len(hookBatch))
+			for _, v := range hookBatch {
+				dataBatch[i] = append(dataBatch[i], v.DeepCopy())
+			}
+		}
+
 		// write to all output
 		// err is not nil only when ctx cancel, dataLoop will certainly return
 		waitGroup := &sync.WaitGroup{}
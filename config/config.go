@@ -12,13 +12,69 @@ type IngressConfig struct {
 	Driver  string                 `yaml:"driver"`
 	Dsn     string                 `yaml:"dsn"`
 	Options map[string]interface{} `yaml:"options"`
+	// run once before the data copy to all egress, e.g. the filter shared by all egress.
+	HookChain []HookConfig `yaml:"hookChain"`
 }
 
 type EgressConfig struct {
 	Driver    string                 `yaml:"driver"`
 	Url       string                 `yaml:"url"`
 	Options   map[string]interface{} `yaml:"options"`
-	HookChain []string               `yaml:"hookChain"`
+	HookChain []HookConfig           `yaml:"hookChain"`
+}
+
+/*
+HookConfig is a hook of hook chain. yaml can be the string form "name(arg1,arg2)",
+or the structured form {name: hookName, args: [arg1, arg2]} and {name: hookName, args: {argName: value}}
+*/
+type HookConfig struct {
+	// string form
+	Str  string
+	Name string
+	// positional args of structured form
+	Args []interface{}
+	// named args of structured form
+	NamedArgs map[string]interface{}
+}
+
+func (h *HookConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	if err := unmarshal(&h.Str); err == nil {
+		return nil
+	}
+	structured := struct {
+		Name string      `yaml:"name"`
+		Args interface{} `yaml:"args"`
+	}{}
+	if err := unmarshal(&structured); err != nil {
+		return err
+	}
+	if structured.Name == "" {
+		return fmt.Errorf("hook name is empty")
+	}
+	h.Name = structured.Name
+	switch args := structured.Args.(type) {
+	case nil:
+	case []interface{}:
+		h.Args = args
+	case map[interface{}]interface{}:
+		h.NamedArgs = make(map[string]interface{}, len(args))
+		for k, v := range args {
+			h.NamedArgs[fmt.Sprint(k)] = v
+		}
+	default:
+		return fmt.Errorf("args of hook %s should be list or map", h.Name)
+	}
+	return nil
+}
+
+func (h HookConfig) String() string {
+	if h.Name == "" {
+		return h.Str
+	}
+	if h.NamedArgs != nil {
+		return fmt.Sprintf("%s(%v)", h.Name, h.NamedArgs)
+	}
+	return fmt.Sprintf("%s(%v)", h.Name, h.Args)
 }
 
 type CanalConfig struct {
@@ -1,58 +1,518 @@
 package clickhouse
 
 import (
+	"fmt"
 	"github.com/enustah/db-canal/config"
 	"github.com/enustah/db-canal/driver"
 	"github.com/enustah/db-canal/register"
 	"github.com/enustah/db-canal/util"
+	"github.com/mitchellh/mapstructure"
 	"gorm.io/driver/clickhouse"
 	"gorm.io/gorm"
+	"strings"
+	"time"
 )
 
 func init() {
 	util.Must(register.RegisterEgressDriver("clickhouse_egress", &ClickhouseEgress{}))
 }
 
+// strategy to handle update and delete
+const (
+	// insert and update append as new row, delete is ignored
+	strategyAppend = "append"
+	// for ReplacingMergeTree(version, is_deleted). every event append a row with version, delete set is_deleted to 1
+	strategyReplacing = "replacing"
+	// for CollapsingMergeTree(sign). update append old row with sign -1 and new row with sign 1, delete append sign -1
+	strategyCollapsing = "collapsing"
+	// update and delete run as mutation by key column, update is delete then insert
+	strategyMutation = "mutation"
+
+	defaultVersionColumn = "_version"
+	defaultDeleteColumn  = "_is_deleted"
+	defaultSignColumn    = "_sign"
+)
+
+// default column type of auto created table
+var chColumnTypeMap = map[driver.ColumnType]string{
+	driver.ColumnTypeNumber: "Int64",
+	driver.ColumnTypeFloat:  "Float64",
+	driver.ColumnDatetime:   "DateTime64(6)",
+}
+
+type chTableOption struct {
+	// append, replacing, collapsing or mutation. default append
+	Strategy string `mapstructure:"strategy"`
+	// replacing strategy, version column, default _version
+	VersionColumn string `mapstructure:"versionColumn"`
+	// replacing strategy, delete flag column, default _is_deleted
+	DeleteColumn string `mapstructure:"deleteColumn"`
+	// collapsing strategy, sign column, default _sign
+	SignColumn string `mapstructure:"signColumn"`
+	// mutation strategy, key columns to locate the row, require
+	KeyColumn []string `mapstructure:"keyColumn"`
+	// mutation strategy, use lightweight `DELETE FROM` instead of `ALTER TABLE ... DELETE`
+	LightweightDelete bool `mapstructure:"lightweightDelete"`
+	// target clickhouse table, default the same as source table name. support {database} and {table} template
+	Target string `mapstructure:"target"`
+	// target clickhouse database, overwrite the targetDatabase of egress option
+	TargetDatabase string `mapstructure:"targetDatabase"`
+	// map<sourceColumn>targetColumn, rename column before write
+	ColumnRename map[string]string `mapstructure:"columnRename"`
+	// source columns not write to clickhouse
+	ColumnExclude []string `mapstructure:"columnExclude"`
+	// auto create table only, engine of the table. default by strategy, e.g. ReplacingMergeTree(_version, _is_deleted)
+	Engine string `mapstructure:"engine"`
+	// auto create table only, ORDER BY columns. default keyColumn, tuple() if both empty
+	OrderBy []string `mapstructure:"orderBy"`
+	// auto create table only, map<targetColumn>clickhouseType, overwrite the type derived from column type
+	ColumnType map[string]string `mapstructure:"columnType"`
+
+	exclude map[string]bool
+}
+
+type chEgressOption struct {
+	// map<table_name or database.table_name>tableOption, the table not config use append strategy
+	Tables map[string]chTableOption `mapstructure:"tables"`
+	// create the target table if not exist when first see it
+	AutoCreateTable bool `mapstructure:"autoCreateTable"`
+	// target clickhouse database of all tables, support {database} and {table} template. e.g. ods_{database}.
+	// default empty, write to the database of url
+	TargetDatabase string `mapstructure:"targetDatabase"`
+	// use clickhouse native protocol with columnar batch insert instead of gorm
+	NativeProtocol bool `mapstructure:"nativeProtocol"`
+	// native protocol only, insert with async_insert setting
+	AsyncInsert bool `mapstructure:"asyncInsert"`
+	// native protocol only, wait for async insert flush before return
+	WaitForAsyncInsert bool `mapstructure:"waitForAsyncInsert"`
+}
+
 type ClickhouseEgress struct {
-	db *gorm.DB
+	driverName string
+	db         *gorm.DB
+	native     *nativeWriter
+	tables     map[string]*chTableOption
+	autoCreate bool
+	targetDb   string
+	// the target tables already created or checked
+	created map[chTable]bool
+	// the target databases already created or checked
+	createdDb map[string]bool
+}
+
+// chTable is the target clickhouse table, database empty means the database of url
+type chTable struct {
+	database string
+	name     string
+}
+
+func (t chTable) String() string {
+	if t.database == "" {
+		return t.name
+	}
+	return t.database + "." + t.name
+}
+
+func (t chTable) quote() string {
+	if t.database == "" {
+		return quoteIdentifier(t.name)
+	}
+	return quoteIdentifier(t.database) + "." + quoteIdentifier(t.name)
+}
+
+// chOp is a group of rows insert or delete on a table. ops of a table must run in order
+type chOp struct {
+	delete bool
+	rows   []map[string]interface{}
 }
 
 func (c *ClickhouseEgress) Init(config config.EgressConfig) error {
+	option := &chEgressOption{}
+	if err := mapstructure.Decode(config.Options, option); err != nil {
+		return err
+	}
+	tables := make(map[string]*chTableOption)
+	for name, o := range option.Tables {
+		o := o
+		switch o.Strategy {
+		case "":
+			o.Strategy = strategyAppend
+		case strategyAppend, strategyCollapsing:
+		case strategyReplacing:
+			if o.VersionColumn == "" {
+				o.VersionColumn = defaultVersionColumn
+			}
+			if o.DeleteColumn == "" {
+				o.DeleteColumn = defaultDeleteColumn
+			}
+		case strategyMutation:
+			if len(o.KeyColumn) == 0 {
+				return fmt.Errorf("key column of table %s is require by mutation strategy", name)
+			}
+		default:
+			return fmt.Errorf("unknown strategy %s of table %s", o.Strategy, name)
+		}
+		if o.Strategy == strategyCollapsing && o.SignColumn == "" {
+			o.SignColumn = defaultSignColumn
+		}
+		o.exclude = make(map[string]bool)
+		for _, col := range o.ColumnExclude {
+			o.exclude[col] = true
+		}
+		tables[name] = &o
+	}
+
 	var err error
+	c.driverName = config.Driver
+	c.tables = tables
+	c.autoCreate = option.AutoCreateTable
+	c.targetDb = option.TargetDatabase
+	c.created = make(map[chTable]bool)
+	c.createdDb = make(map[string]bool)
+	if option.NativeProtocol {
+		c.native, err = newNativeWriter(config.Url, option.AsyncInsert, option.WaitForAsyncInsert)
+		return err
+	}
 	c.db, err = gorm.Open(clickhouse.Open(config.Url), &gorm.Config{})
 	return err
 }
 
 func (c *ClickhouseEgress) Start() error {
+	if c.native != nil {
+		return c.native.ping()
+	}
 	_, err := c.db.Raw("select 1").Rows()
 	return err
 }
 
 func (c *ClickhouseEgress) WriteData(dataBatch []*driver.Data) error {
-	// map<tableName,rawMap[]>
-	m := make(map[string][]map[string]interface{})
+	var (
+		// map<targetTable,op[]>
+		m     = make(map[chTable][]*chOp)
+		order = make([]chTable, 0)
+		// map<targetTable,tableOption>, the first source table option of target
+		options = make(map[chTable]*chTableOption)
+		// map<targetTable,columnName[]>, the column order of native insert
+		column = make(map[chTable][]string)
+		// version of replacing strategy, increase in data batch to keep the order
+		version = uint64(time.Now().UnixNano())
+	)
 	for _, v := range dataBatch {
+		option := c.tableOption(v)
+		target := c.targetTable(v, option)
+		tableColumn := mapColumn(option, v.Table.Column)
+		if _, ok := m[target]; !ok {
+			order = append(order, target)
+			options[target] = option
+		}
+		if c.autoCreate && !c.created[target] {
+			if err := c.createTable(target, option, tableColumn); err != nil {
+				util.GetLog().WithField("driver", c.driverName).
+					WithField("table", target.String()).
+					WithField("error", err).
+					Errorf("clickhouse create table fail")
+				return err
+			}
+			c.created[target] = true
+		}
+		column[target] = mergeColumn(column[target], tableColumn)
+		for _, op := range c.convertData(v, option, version) {
+			m[target] = appendOp(m[target], op)
+		}
+		version++
+	}
+
+	for _, table := range order {
+		for _, op := range m[table] {
+			var err error
+			if op.delete {
+				err = c.deleteRows(table, options[table], op.rows)
+			} else if c.native != nil {
+				err = c.native.insert(table, column[table], op.rows)
+			} else {
+				err = c.db.Transaction(func(tx *gorm.DB) error {
+					return tx.Table(table.String()).Create(op.rows).Error
+				})
+			}
+			if err != nil {
+				util.GetLog().WithField("driver", c.driverName).
+					WithField("table", table.String()).
+					WithField("error", err).
+					Errorf("clickhouse write data fail")
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (c *ClickhouseEgress) Stop() {
+	if c.native != nil {
+		c.native.close()
+	}
+}
+
+// get the option of data table, database.table first then table
+func (c *ClickhouseEgress) tableOption(data *driver.Data) *chTableOption {
+	if option, ok := c.tables[data.Database.Name+"."+data.Table.Name]; ok {
+		return option
+	}
+	if option, ok := c.tables[data.Table.Name]; ok {
+		return option
+	}
+	return &chTableOption{Strategy: strategyAppend}
+}
+
+// get the target table of data, source database and table is the default
+func (c *ClickhouseEgress) targetTable(data *driver.Data, option *chTableOption) chTable {
+	render := func(tmpl string) string {
+		return strings.NewReplacer("{database}", data.Database.Name, "{table}", data.Table.Name).Replace(tmpl)
+	}
+	t := chTable{
+		database: render(c.targetDb),
+		name:     data.Table.Name,
+	}
+	if option.TargetDatabase != "" {
+		t.database = render(option.TargetDatabase)
+	}
+	if option.Target != "" {
+		t.name = render(option.Target)
+	}
+	return t
+}
+
+// convert data to insert or delete op according to table strategy
+func (c *ClickhouseEgress) convertData(data *driver.Data, option *chTableOption, version uint64) []*chOp {
+	var (
+		raw = mapRow(option, data.RawMap)
+		old = mapRow(option, data.OldDataMap)
+	)
+	insert := func(row map[string]interface{}) *chOp {
+		return &chOp{rows: []map[string]interface{}{row}}
+	}
+
+	switch option.Strategy {
+	case strategyReplacing:
+		if data.Event != driver.EventInsert && data.Event != driver.EventUpdate && data.Event != driver.EventDelete {
+			return nil
+		}
+		raw[option.VersionColumn] = version
+		raw[option.DeleteColumn] = uint8(0)
+		if data.Event == driver.EventDelete {
+			raw[option.DeleteColumn] = uint8(1)
+		}
+		return []*chOp{insert(raw)}
+	case strategyCollapsing:
+		withSign := func(row map[string]interface{}, sign int8) map[string]interface{} {
+			row[option.SignColumn] = sign
+			return row
+		}
+		switch data.Event {
+		case driver.EventInsert:
+			return []*chOp{insert(withSign(raw, 1))}
+		case driver.EventUpdate:
+			if old == nil {
+				util.GetLog().WithField("driver", c.driverName).
+					WithField("table", data.Table.Name).
+					Warnf("update without old data, can not cancel the old row")
+				return []*chOp{insert(withSign(raw, 1))}
+			}
+			return []*chOp{insert(withSign(old, -1)), insert(withSign(raw, 1))}
+		case driver.EventDelete:
+			return []*chOp{insert(withSign(raw, -1))}
+		}
+	case strategyMutation:
+		switch data.Event {
+		case driver.EventInsert:
+			return []*chOp{insert(raw)}
+		case driver.EventUpdate:
+			if old == nil {
+				old = raw
+			}
+			return []*chOp{{delete: true, rows: []map[string]interface{}{old}}, insert(raw)}
+		case driver.EventDelete:
+			return []*chOp{{delete: true, rows: []map[string]interface{}{raw}}}
+		}
+	default:
 		// ignore delete
-		if v.Event == driver.EventDelete {
+		if data.Event == driver.EventInsert || data.Event == driver.EventUpdate {
+			return []*chOp{insert(raw)}
+		}
+	}
+	return nil
+}
+
+// copy the row with column renamed and excluded
+func mapRow(option *chTableOption, row map[string]interface{}) map[string]interface{} {
+	if row == nil {
+		return nil
+	}
+	m := make(map[string]interface{}, len(row))
+	for k, v := range row {
+		if option.exclude[k] {
 			continue
 		}
-		_, ok := m[v.Table.Name]
-		if !ok {
-			m[v.Table.Name] = make([]map[string]interface{}, 0, len(dataBatch))
+		if name, ok := option.ColumnRename[k]; ok {
+			k = name
 		}
-		m[v.Table.Name] = append(m[v.Table.Name], v.RawMap)
+		m[k] = v
 	}
-	return c.db.Transaction(func(tx *gorm.DB) error {
-		var err error
-		for k, v := range m {
-			if err == nil {
-				err = tx.Table(k).Create(v).Error
+	return m
+}
+
+func mapColumn(option *chTableOption, tableColumn []*driver.Column) []*driver.Column {
+	column := make([]*driver.Column, 0, len(tableColumn))
+	for _, v := range tableColumn {
+		if option.exclude[v.Name] {
+			continue
+		}
+		if name, ok := option.ColumnRename[v.Name]; ok {
+			column = append(column, &driver.Column{Name: name, Type: v.Type, Metadata: v.Metadata})
+			continue
+		}
+		column = append(column, v)
+	}
+	return column
+}
+
+func mergeColumn(column []string, tableColumn []*driver.Column) []string {
+	for _, tc := range tableColumn {
+		found := false
+		for _, c := range column {
+			if c == tc.Name {
+				found = true
+				break
 			}
 		}
-		return err
-	})
+		if !found {
+			column = append(column, tc.Name)
+		}
+	}
+	return column
 }
 
-func (c *ClickhouseEgress) Stop() {
+// append op to ops, merge with the last op if they are the same kind
+func appendOp(ops []*chOp, op *chOp) []*chOp {
+	if len(ops) != 0 && ops[len(ops)-1].delete == op.delete {
+		last := ops[len(ops)-1]
+		last.rows = append(last.rows, op.rows...)
+		return ops
+	}
+	return append(ops, op)
+}
+
+/*
+delete rows by key column. mutation only affect the data parts exist when it submit,
+so the rows insert after it will not be deleted.
+*/
+func (c *ClickhouseEgress) deleteRows(table chTable, option *chTableOption, rows []map[string]interface{}) error {
+	var (
+		quoteKeys = make([]string, 0, len(option.KeyColumn))
+		tuples    = make([]string, 0, len(rows))
+		args      = make([]interface{}, 0, len(rows)*len(option.KeyColumn))
+	)
+	for _, k := range option.KeyColumn {
+		quoteKeys = append(quoteKeys, quoteIdentifier(k))
+	}
+	for _, row := range rows {
+		placeholder := make([]string, 0, len(option.KeyColumn))
+		for _, k := range option.KeyColumn {
+			v, ok := row[k]
+			if !ok {
+				return fmt.Errorf("key column %s not found in table %s", k, table.String())
+			}
+			args = append(args, v)
+			placeholder = append(placeholder, "?")
+		}
+		tuples = append(tuples, "("+strings.Join(placeholder, ",")+")")
+	}
+	condition := fmt.Sprintf("(%s) IN (%s)", strings.Join(quoteKeys, ","), strings.Join(tuples, ","))
+
+	sql := fmt.Sprintf("ALTER TABLE %s DELETE WHERE %s", table.quote(), condition)
+	if option.LightweightDelete {
+		sql = fmt.Sprintf("DELETE FROM %s WHERE %s", table.quote(), condition)
+	}
+	return c.exec(sql, args...)
+}
+
+/*
+create the target table if not exist. column type derived from the column type of source table,
+the column in ORDER BY can not be nullable, so all columns are not nullable and the null value
+write as zero value.
+*/
+func (c *ClickhouseEgress) createTable(table chTable, option *chTableOption, tableColumn []*driver.Column) error {
+	if table.database != "" && !c.createdDb[table.database] {
+		if err := c.exec(fmt.Sprintf("CREATE DATABASE IF NOT EXISTS %s", quoteIdentifier(table.database))); err != nil {
+			return err
+		}
+		c.createdDb[table.database] = true
+	}
+	var (
+		columns = make([]string, 0, len(tableColumn)+2)
+		exist   = make(map[string]bool)
+		engine  = option.Engine
+		orderBy = option.OrderBy
+	)
+	addColumn := func(name, typ string) {
+		if exist[name] {
+			return
+		}
+		exist[name] = true
+		if t, ok := option.ColumnType[name]; ok {
+			typ = t
+		}
+		columns = append(columns, quoteIdentifier(name)+" "+typ)
+	}
+	for _, v := range tableColumn {
+		typ, ok := chColumnTypeMap[v.Type]
+		if !ok {
+			typ = "String"
+		}
+		addColumn(v.Name, typ)
+	}
+	switch option.Strategy {
+	case strategyReplacing:
+		addColumn(option.VersionColumn, "UInt64")
+		addColumn(option.DeleteColumn, "UInt8")
+		if engine == "" {
+			engine = fmt.Sprintf("ReplacingMergeTree(%s, %s)", quoteIdentifier(option.VersionColumn), quoteIdentifier(option.DeleteColumn))
+		}
+	case strategyCollapsing:
+		addColumn(option.SignColumn, "Int8")
+		if engine == "" {
+			engine = fmt.Sprintf("CollapsingMergeTree(%s)", quoteIdentifier(option.SignColumn))
+		}
+	}
+	if engine == "" {
+		engine = "MergeTree()"
+	}
+	if len(orderBy) == 0 {
+		orderBy = option.KeyColumn
+	}
+	order := "tuple()"
+	if len(orderBy) != 0 {
+		quoteOrder := make([]string, 0, len(orderBy))
+		for _, v := range orderBy {
+			quoteOrder = append(quoteOrder, quoteIdentifier(v))
+		}
+		order = "(" + strings.Join(quoteOrder, ",") + ")"
+	}
+
+	sql := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (%s) ENGINE = %s ORDER BY %s",
+		table.quote(), strings.Join(columns, ", "), engine, order)
+	util.GetLog().WithField("driver", c.driverName).
+		WithField("sql", sql).
+		Infof("auto create clickhouse table")
+	return c.exec(sql)
+}
+
+func (c *ClickhouseEgress) exec(sql string, args ...interface{}) error {
+	if c.native != nil {
+		return c.native.exec(sql, args...)
+	}
+	return c.db.Exec(sql, args...).Error
+}
 
+func quoteIdentifier(s string) string {
+	return "`" + strings.ReplaceAll(s, "`", "\\`") + "`"
 }
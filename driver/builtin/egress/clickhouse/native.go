@@ -0,0 +1,507 @@
+package clickhouse
+
+import (
+	"database/sql"
+	"fmt"
+	_ "github.com/ClickHouse/clickhouse-go"
+	"github.com/shopspring/decimal"
+	"math"
+	"math/big"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	timeType = reflect.TypeOf(time.Time{})
+	// clickhouse type to the go type which clickhouse-go column writer accept
+	chGoTypeMap = map[string]reflect.Type{
+		"Int8":    reflect.TypeOf(int8(0)),
+		"Int16":   reflect.TypeOf(int16(0)),
+		"Int32":   reflect.TypeOf(int32(0)),
+		"Int64":   reflect.TypeOf(int64(0)),
+		"UInt8":   reflect.TypeOf(uint8(0)),
+		"UInt16":  reflect.TypeOf(uint16(0)),
+		"UInt32":  reflect.TypeOf(uint32(0)),
+		"UInt64":  reflect.TypeOf(uint64(0)),
+		"Float32": reflect.TypeOf(float32(0)),
+		"Float64": reflect.TypeOf(float64(0)),
+		"String":  reflect.TypeOf(""),
+		"Date":    timeType,
+	}
+	// parameterized clickhouse type prefix to go type
+	chGoTypePrefixMap = map[string]reflect.Type{
+		"FixedString(": reflect.TypeOf(""),
+		"Enum8(":       reflect.TypeOf(""),
+		"Enum16(":      reflect.TypeOf(""),
+		"DateTime":     timeType,
+	}
+)
+
+/*
+nativeWriter insert rows by clickhouse native protocol. clickhouse-go buffer the rows of
+a prepared insert into columnar blocks and send them on commit, so a batch is one insert query.
+*/
+type nativeWriter struct {
+	db       *sql.DB
+	settings string
+	lock     *sync.Mutex
+	// map<table>map<column>clickhouseType, cache the column type of target table
+	columnType map[chTable]map[string]string
+}
+
+type chColumnType struct {
+	// nil means the type is not supported to convert, the value pass to driver directly
+	typ reflect.Type
+	// not nil if the column is Decimal
+	decimal  *chDecimal
+	nullable bool
+}
+
+// clickhouse-go write Decimal from the integer scaled by 10^scale, precision > 18 is 16 bytes of Decimal128
+type chDecimal struct {
+	precision int
+	scale     int
+}
+
+func newNativeWriter(url string, asyncInsert, waitAsyncInsert bool) (*nativeWriter, error) {
+	db, err := sql.Open("clickhouse", url)
+	if err != nil {
+		return nil, err
+	}
+	// async_insert is not in the dsn setting whitelist of clickhouse-go, set it in insert query
+	settings := ""
+	if asyncInsert {
+		settings = " SETTINGS async_insert=1, wait_for_async_insert=0"
+		if waitAsyncInsert {
+			settings = " SETTINGS async_insert=1, wait_for_async_insert=1"
+		}
+	}
+	return &nativeWriter{
+		db:         db,
+		settings:   settings,
+		lock:       &sync.Mutex{},
+		columnType: make(map[chTable]map[string]string),
+	}, nil
+}
+
+func (n *nativeWriter) ping() error {
+	return n.db.Ping()
+}
+
+func (n *nativeWriter) exec(sql string, args ...interface{}) error {
+	_, err := n.db.Exec(sql, args...)
+	return err
+}
+
+func (n *nativeWriter) close() error {
+	return n.db.Close()
+}
+
+// insert rows in one batch. column order follow tableColumn, then the column only exist in rows
+func (n *nativeWriter) insert(table chTable, tableColumn []string, rows []map[string]interface{}) error {
+	columnType, err := n.getColumnType(table)
+	if err != nil {
+		return err
+	}
+	var (
+		column      = orderColumn(tableColumn, rows)
+		quoteColumn = make([]string, 0, len(column))
+		placeholder = make([]string, 0, len(column))
+		// only resolve the type of inserted column
+		insertType = make(map[string]*chColumnType, len(column))
+	)
+	for _, c := range column {
+		typ, ok := columnType[c]
+		if !ok {
+			// column may add after cache, fetch it again next time
+			n.lock.Lock()
+			delete(n.columnType, table)
+			n.lock.Unlock()
+			return fmt.Errorf("column %s not found in clickhouse table %s", c, table.String())
+		}
+		insertType[c] = parseColumnType(typ)
+		quoteColumn = append(quoteColumn, quoteIdentifier(c))
+		placeholder = append(placeholder, "?")
+	}
+
+	tx, err := n.db.Begin()
+	if err != nil {
+		return err
+	}
+	stmt, err := tx.Prepare(fmt.Sprintf("INSERT INTO %s (%s)%s VALUES (%s)",
+		table.quote(), strings.Join(quoteColumn, ","), n.settings, strings.Join(placeholder, ",")))
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	defer stmt.Close()
+	for _, row := range rows {
+		args := make([]interface{}, 0, len(column))
+		for _, c := range column {
+			v, err := convertValue(row[c], insertType[c])
+			if err != nil {
+				tx.Rollback()
+				return fmt.Errorf("column %s: %v", c, err)
+			}
+			args = append(args, v)
+		}
+		if _, err = stmt.Exec(args...); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (n *nativeWriter) getColumnType(table chTable) (map[string]string, error) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if m, ok := n.columnType[table]; ok {
+		return m, nil
+	}
+	var (
+		rows *sql.Rows
+		err  error
+	)
+	if table.database == "" {
+		rows, err = n.db.Query("SELECT name, type FROM system.columns WHERE database = currentDatabase() AND table = ?", table.name)
+	} else {
+		rows, err = n.db.Query("SELECT name, type FROM system.columns WHERE database = ? AND table = ?", table.database, table.name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	m := make(map[string]string)
+	for rows.Next() {
+		var name, typ string
+		if err = rows.Scan(&name, &typ); err != nil {
+			return nil, err
+		}
+		m[name] = typ
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(m) == 0 {
+		return nil, fmt.Errorf("clickhouse table %s not found", table.String())
+	}
+	n.columnType[table] = m
+	return m, nil
+}
+
+// parse the clickhouse type, unknown type like Bool, UUID, Array and Map is passed through
+func parseColumnType(typ string) *chColumnType {
+	t := &chColumnType{}
+	if strings.HasPrefix(typ, "LowCardinality(") {
+		typ = strings.TrimSuffix(strings.TrimPrefix(typ, "LowCardinality("), ")")
+	}
+	if strings.HasPrefix(typ, "Nullable(") {
+		typ = strings.TrimSuffix(strings.TrimPrefix(typ, "Nullable("), ")")
+		t.nullable = true
+	}
+	if goType, ok := chGoTypeMap[typ]; ok {
+		t.typ = goType
+		return t
+	}
+	if strings.HasPrefix(typ, "Decimal") {
+		t.decimal = parseDecimal(typ)
+		return t
+	}
+	for prefix, goType := range chGoTypePrefixMap {
+		if strings.HasPrefix(typ, prefix) {
+			t.typ = goType
+			return t
+		}
+	}
+	return t
+}
+
+// the columns of tableColumn first, then other columns in rows by name
+func orderColumn(tableColumn []string, rows []map[string]interface{}) []string {
+	var (
+		column = make([]string, 0, len(tableColumn))
+		exist  = make(map[string]bool)
+		extra  = make([]string, 0)
+	)
+	for _, row := range rows {
+		for k := range row {
+			exist[k] = true
+		}
+	}
+	for _, c := range tableColumn {
+		if exist[c] {
+			column = append(column, c)
+			delete(exist, c)
+		}
+	}
+	for c := range exist {
+		extra = append(extra, c)
+	}
+	sort.Strings(extra)
+	return append(column, extra...)
+}
+
+// parse Decimal(P, S) or Decimal32(S), Decimal64(S), Decimal128(S). return nil if not support
+func parseDecimal(typ string) *chDecimal {
+	d := &chDecimal{}
+	if _, err := fmt.Sscanf(typ, "Decimal(%d, %d)", &d.precision, &d.scale); err == nil && d.precision <= 38 {
+		return d
+	}
+	for prefix, precision := range map[string]int{"Decimal32(": 9, "Decimal64(": 18, "Decimal128(": 38} {
+		if _, err := fmt.Sscanf(typ, prefix+"%d)", &d.scale); err == nil && strings.HasPrefix(typ, prefix) {
+			d.precision = precision
+			return d
+		}
+	}
+	return nil
+}
+
+// convert value to the go type of clickhouse column, nil is zero value if column is not nullable
+func convertValue(v interface{}, t *chColumnType) (interface{}, error) {
+	if t.typ == nil && t.decimal == nil {
+		return v, nil
+	}
+	if v == nil {
+		if t.nullable {
+			return nil, nil
+		}
+		if t.decimal != nil {
+			return t.decimal.value(decimal.Zero)
+		}
+		return reflect.Zero(t.typ).Interface(), nil
+	}
+	if t.decimal != nil {
+		d, err := toDecimal(v)
+		if err != nil {
+			return nil, err
+		}
+		return t.decimal.value(d)
+	}
+	val := reflect.ValueOf(v)
+	if val.Type() == t.typ {
+		return v, nil
+	}
+	fail := func() (interface{}, error) {
+		return nil, fmt.Errorf("can not convert %T to %s", v, t.typ)
+	}
+
+	if t.typ == timeType {
+		if isInteger(val) {
+			return time.Unix(toInt64(val), 0), nil
+		}
+		if s, ok := v.(string); ok {
+			return s, nil
+		}
+		return fail()
+	}
+
+	switch t.typ.Kind() {
+	case reflect.String:
+		switch b := v.(type) {
+		case []byte:
+			return string(b), nil
+		case time.Time:
+			return b.Format("2006-01-02 15:04:05"), nil
+		}
+		return fmt.Sprintf("%v", v), nil
+	default:
+		return convertNumber(v, t.typ)
+	}
+}
+
+/*
+convertNumber convert the value to the integer or float type without losing precision.
+string is parsed by the target type, float is truncated to integer, out of range value is error
+*/
+func convertNumber(v interface{}, typ reflect.Type) (interface{}, error) {
+	var (
+		out = reflect.New(typ).Elem()
+		val = reflect.ValueOf(v)
+	)
+	overflow := func() (interface{}, error) {
+		return nil, fmt.Errorf("%v out of %s range", v, typ)
+	}
+	switch n := v.(type) {
+	case bool:
+		val = reflect.ValueOf(int64(0))
+		if n {
+			val = reflect.ValueOf(int64(1))
+		}
+	case string, []byte:
+		var (
+			str = strings.TrimSpace(fmt.Sprintf("%s", n))
+			err error
+		)
+		switch {
+		case isIntKind(typ.Kind()):
+			var i int64
+			if i, err = strconv.ParseInt(str, 10, typ.Bits()); err == nil {
+				out.SetInt(i)
+			}
+		case isUintKind(typ.Kind()):
+			var u uint64
+			if u, err = strconv.ParseUint(str, 10, typ.Bits()); err == nil {
+				out.SetUint(u)
+			}
+		default:
+			var f float64
+			if f, err = strconv.ParseFloat(str, typ.Bits()); err == nil {
+				out.SetFloat(f)
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("can not convert %q to %s: %v", str, typ, err)
+		}
+		return out.Interface(), nil
+	case decimal.Decimal:
+		if typ.Kind() == reflect.Float32 || typ.Kind() == reflect.Float64 {
+			f, _ := n.Float64()
+			val = reflect.ValueOf(f)
+			break
+		}
+		i := n.BigInt()
+		switch {
+		case i.IsInt64():
+			val = reflect.ValueOf(i.Int64())
+		case i.IsUint64():
+			val = reflect.ValueOf(i.Uint64())
+		default:
+			return overflow()
+		}
+	}
+
+	switch {
+	case isIntKind(val.Kind()):
+		i := val.Int()
+		switch {
+		case isIntKind(typ.Kind()):
+			if out.OverflowInt(i) {
+				return overflow()
+			}
+			out.SetInt(i)
+		case isUintKind(typ.Kind()):
+			if i < 0 || out.OverflowUint(uint64(i)) {
+				return overflow()
+			}
+			out.SetUint(uint64(i))
+		default:
+			out.SetFloat(float64(i))
+		}
+	case isUintKind(val.Kind()):
+		u := val.Uint()
+		switch {
+		case isIntKind(typ.Kind()):
+			if u > math.MaxInt64 || out.OverflowInt(int64(u)) {
+				return overflow()
+			}
+			out.SetInt(int64(u))
+		case isUintKind(typ.Kind()):
+			if out.OverflowUint(u) {
+				return overflow()
+			}
+			out.SetUint(u)
+		default:
+			out.SetFloat(float64(u))
+		}
+	case val.Kind() == reflect.Float32 || val.Kind() == reflect.Float64:
+		f := val.Float()
+		switch {
+		case isIntKind(typ.Kind()):
+			limit := math.Ldexp(1, typ.Bits()-1)
+			if math.IsNaN(f) || f < -limit || f >= limit {
+				return overflow()
+			}
+			out.SetInt(int64(f))
+		case isUintKind(typ.Kind()):
+			if math.IsNaN(f) || f < 0 || f >= math.Ldexp(1, typ.Bits()) {
+				return overflow()
+			}
+			out.SetUint(uint64(f))
+		default:
+			if out.OverflowFloat(f) {
+				return overflow()
+			}
+			out.SetFloat(f)
+		}
+	default:
+		return nil, fmt.Errorf("can not convert %T to %s", v, typ)
+	}
+	return out.Interface(), nil
+}
+
+func toDecimal(v interface{}) (decimal.Decimal, error) {
+	switch n := v.(type) {
+	case decimal.Decimal:
+		return n, nil
+	case string:
+		return decimal.NewFromString(strings.TrimSpace(n))
+	case []byte:
+		return decimal.NewFromString(strings.TrimSpace(string(n)))
+	case float32:
+		return decimal.NewFromFloat32(n), nil
+	case float64:
+		return decimal.NewFromFloat(n), nil
+	}
+	val := reflect.ValueOf(v)
+	switch {
+	case isIntKind(val.Kind()):
+		return decimal.NewFromInt(val.Int()), nil
+	case isUintKind(val.Kind()):
+		return decimal.NewFromBigInt(new(big.Int).SetUint64(val.Uint()), 0), nil
+	}
+	return decimal.Zero, fmt.Errorf("can not convert %T to decimal", v)
+}
+
+// the scaled integer of decimal, the digits out of scale is truncated
+func (d *chDecimal) value(v decimal.Decimal) (interface{}, error) {
+	i := v.Shift(int32(d.scale)).Truncate(0).BigInt()
+	limit := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(d.precision)), nil)
+	if new(big.Int).Abs(i).Cmp(limit) >= 0 {
+		return nil, fmt.Errorf("%s out of Decimal(%d, %d) range", v, d.precision, d.scale)
+	}
+	if d.precision <= 18 {
+		return i.Int64(), nil
+	}
+	// 16 bytes little endian two's complement
+	if i.Sign() < 0 {
+		i.Add(i, new(big.Int).Lsh(big.NewInt(1), 128))
+	}
+	b := i.FillBytes(make([]byte, 16))
+	for l, r := 0, len(b)-1; l < r; l, r = l+1, r-1 {
+		b[l], b[r] = b[r], b[l]
+	}
+	return b, nil
+}
+
+func isIntKind(k reflect.Kind) bool {
+	switch k {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return true
+	}
+	return false
+}
+
+func isUintKind(k reflect.Kind) bool {
+	switch k {
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return true
+	}
+	return false
+}
+
+func isInteger(v reflect.Value) bool {
+	return isIntKind(v.Kind()) || isUintKind(v.Kind())
+}
+
+func toInt64(v reflect.Value) int64 {
+	switch v.Kind() {
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return int64(v.Uint())
+	}
+	return v.Int()
+}
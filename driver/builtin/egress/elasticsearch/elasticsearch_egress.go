@@ -5,6 +5,7 @@ import (
 	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -19,17 +20,33 @@ import (
 	"net/url"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+const (
+	defaultIDSeparator   = "_"
+	defaultFlushInterval = time.Second
+)
+
 func init() {
 	util.Must(register.RegisterEgressDriver("elasticsearch_egress", &ElasticsearchEgress{}))
 }
 
 type esEgressOption struct {
-	// map<table_name>idColumnName, require
-	IDColumn        map[string]string `mapstructure:"idColumn"`
-	IgnoreDelete404 bool              `mapstructure:"ignoreDelete404"`
+	// map<table_name or database.table_name>idColumnName, require. the value can be a column name or
+	// a list of column name, the composite id is the value of columns join with idSeparator
+	IDColumn map[string]interface{} `mapstructure:"idColumn"`
+	// separator of composite id, default _
+	IDSeparator     string `mapstructure:"idSeparator"`
+	IgnoreDelete404 bool   `mapstructure:"ignoreDelete404"`
+	// ignore 409 version conflict, e.g. the doc already has a newer external version
+	IgnoreConflict409 bool `mapstructure:"ignoreConflict409"`
+	// map<table_name or database.table_name>indexOption, the table not config write to index {table}
+	Indices map[string]esIndexOption `mapstructure:"indices"`
+	// map<child table_name or database.table_name>nestedOption, the child row write to parent doc instead of its index
+	Nested map[string]esNestedOption `mapstructure:"nested"`
 	// the follow option relate to esutil.BulkIndexerConfig
 	NumWorkers    int    `mapstructure:"numWorkers"`
 	FlushBytes    int    `mapstructure:"flushBytes"`
@@ -49,12 +66,39 @@ type ElasticsearchEgress struct {
 	driverName      string
 	ctx             context.Context
 	client          *elasticsearch.Client
-	idColumn        map[string]string
+	idColumn        map[string][]string
+	idSeparator     string
 	ignoreDelete404 bool
+	ignoreConflict  bool
+	indices         map[string]*esIndexOption
+	nested          map[string]*esNestedOption
+	defaultIndex    *esIndexOption
+	// map<index>alias, the concrete index already add to alias
+	aliased map[string]string
+	// map<pipeline>bulkIndexer, create in Start and close in Stop
+	bulk map[string]esutil.BulkIndexer
+	// the writing data batch, nil if not writing
+	batch *esBatch
+	lock  *sync.Mutex
 
 	FlushBytes    int
 	FlushInterval time.Duration
 	NumWorkers    int
+	// skip the product check of client, set before Init. for the compatible server like opensearch
+	SkipProductCheck bool
+}
+
+// productHeaderTransport add the product header to response, make the client accept the compatible server
+type productHeaderTransport struct {
+	http.RoundTripper
+}
+
+func (t *productHeaderTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.RoundTripper.RoundTrip(req)
+	if err == nil {
+		resp.Header.Set("X-Elastic-Product", "Elasticsearch")
+	}
+	return resp, err
 }
 
 func (e *ElasticsearchEgress) Init(config config.EgressConfig) error {
@@ -89,30 +133,90 @@ func (e *ElasticsearchEgress) Init(config config.EgressConfig) error {
 		if err != nil {
 			return err
 		}
+	} else {
+		// WriteData wait for the flush of bulk indexer, do not wait too long
+		flushInterval = defaultFlushInterval
+	}
+	idColumn := make(map[string][]string)
+	for name, v := range option.IDColumn {
+		var column []string
+		switch c := v.(type) {
+		case string:
+			column = []string{c}
+		case []interface{}:
+			for _, col := range c {
+				s, ok := col.(string)
+				if !ok {
+					return fmt.Errorf("id column of table %s must be string or string list", name)
+				}
+				column = append(column, s)
+			}
+		case []string:
+			column = c
+		default:
+			return fmt.Errorf("id column of table %s must be string or string list", name)
+		}
+		if len(column) == 0 {
+			return fmt.Errorf("id column of table %s is empty", name)
+		}
+		idColumn[name] = column
+	}
+	if option.IDSeparator == "" {
+		option.IDSeparator = defaultIDSeparator
+	}
+	indices := make(map[string]*esIndexOption)
+	for name, o := range option.Indices {
+		o := o
+		if err = o.init(); err != nil {
+			return fmt.Errorf("index option of table %s: %v", name, err)
+		}
+		indices[name] = &o
+	}
+	nested := make(map[string]*esNestedOption)
+	for name, o := range option.Nested {
+		o := o
+		if err = o.init(); err != nil {
+			return fmt.Errorf("nested option of table %s: %v", name, err)
+		}
+		nested[name] = &o
 	}
+	defaultIndex := &esIndexOption{}
+	util.Must(defaultIndex.init())
 	if option.Proxy != "" {
 		proxy = func(r *http.Request) (*url.URL, error) {
 			return url.Parse(option.Proxy)
 		}
 	}
 
+	var transport http.RoundTripper = &http.Transport{
+		Proxy:           proxy,
+		TLSClientConfig: tlsConfig,
+	}
+	if e.SkipProductCheck {
+		transport = &productHeaderTransport{transport}
+	}
+
 	e.ctx = context.Background()
 	e.driverName = config.Driver
 	e.FlushInterval = flushInterval
 	e.FlushBytes = option.FlushBytes
 	e.NumWorkers = option.NumWorkers
-	e.idColumn = option.IDColumn
+	e.idColumn = idColumn
+	e.idSeparator = option.IDSeparator
 	e.ignoreDelete404 = option.IgnoreDelete404
+	e.ignoreConflict = option.IgnoreConflict409
+	e.indices = indices
+	e.nested = nested
+	e.defaultIndex = defaultIndex
+	e.aliased = make(map[string]string)
+	e.lock = &sync.Mutex{}
 	e.client, err = elasticsearch.NewClient(elasticsearch.Config{
 		Addresses:    addr,
 		Username:     option.Username,
 		Password:     option.Password,
 		APIKey:       option.APIKey,
 		ServiceToken: option.ServiceToken,
-		Transport: &http.Transport{
-			Proxy:           proxy,
-			TLSClientConfig: tlsConfig,
-		},
+		Transport:    transport,
 	})
 	return err
 }
@@ -124,54 +228,150 @@ func (e *ElasticsearchEgress) Start() error {
 			err = fmt.Errorf("get info return status code %d", resp.StatusCode)
 		}
 	}
+	if err != nil {
+		return err
+	}
+	e.lock.Lock()
+	e.bulk = make(map[string]esutil.BulkIndexer)
+	e.lock.Unlock()
+	_, err = e.getBulk("")
 	return err
 }
 
+/*
+WriteData add items to the long-lived bulk indexer and wait until all items of the batch is flushed.
+the bulk indexer flush every flushInterval, so WriteData take at most flushInterval plus request time.
+*/
 func (e *ElasticsearchEgress) WriteData(dataBatch []*driver.Data) error {
-	var (
-		// count error ignore
-		ignoreFailCount uint64 = 0
-		data                   = splitData(dataBatch, e.idColumn)
-		bulk, err              = esutil.NewBulkIndexer(esutil.BulkIndexerConfig{
-			Client:        e.client,
-			FlushBytes:    e.FlushBytes,
-			FlushInterval: e.FlushInterval,
-			NumWorkers:    e.NumWorkers,
-		})
-	)
-	util.Must(err)
+	data, aliases, err := e.splitData(dataBatch)
+	if err != nil {
+		util.GetLog().WithField("driver", e.driverName).
+			WithField("error", err).
+			Errorf("elasticsearch convert data fail")
+		return err
+	}
+	for index, alias := range aliases {
+		if err := e.ensureAlias(index, alias); err != nil {
+			util.GetLog().WithField("driver", e.driverName).
+				WithField("index", index).
+				WithField("alias", alias).
+				WithField("error", err).
+				Errorf("elasticsearch add index to alias fail")
+			return err
+		}
+	}
+
+	total := 0
 	for _, v := range data {
+		total += len(v)
+	}
+	if total == 0 {
+		return nil
+	}
+	batch := newEsBatch(total)
+	e.lock.Lock()
+	e.batch = batch
+	e.lock.Unlock()
+	defer func() {
+		e.lock.Lock()
+		e.batch = nil
+		e.lock.Unlock()
+	}()
+
+	for pipeline, v := range data {
+		bulk, err := e.getBulk(pipeline)
+		if err != nil {
+			return err
+		}
 		for _, item := range v {
-			i := *item
+			i, ignoreMissing := item.BulkIndexerItem, item.ignoreMissing
+			i.OnSuccess = func(context.Context, esutil.BulkIndexerItem, esutil.BulkIndexerResponseItem) {
+				batch.done()
+			}
 			i.OnFailure = func(_ context.Context, req esutil.BulkIndexerItem, resp esutil.BulkIndexerResponseItem, err error) {
 				// check fail is ignore
-				if e.isFailIgnore(&req, &resp, err) {
-					ignoreFailCount++
+				if e.isFailIgnore(&req, &resp, err, ignoreMissing) {
+					atomic.AddUint64(&batch.ignore, 1)
+				} else {
+					atomic.AddUint64(&batch.fail, 1)
 				}
+				batch.done()
+			}
+			if err := bulk.Add(e.ctx, i); err != nil {
+				e.closeBulk()
+				return err
 			}
-			bulk.Add(e.ctx, i)
 		}
 	}
-	if err := bulk.Close(e.ctx); err != nil {
+
+	select {
+	case <-batch.finish:
+	case err := <-batch.err:
+		// flush the items of batch left in bulk indexers, or they write after the retry of the batch
+		e.closeBulk()
 		return err
 	}
-	failCount := bulk.Stats().NumFailed
-	if failCount != 0 {
+	if batch.fail != 0 || batch.ignore != 0 {
 		util.GetLog().WithField("driver", e.driverName).
-			Warnf("es write data not all success. total: %d, fail: %d, ignore: %d", len(dataBatch), failCount, ignoreFailCount)
-		if failCount == ignoreFailCount {
-			return nil
+			Warnf("es write data not all success. total: %d, fail: %d, ignore: %d", total, batch.fail, batch.ignore)
+		if batch.fail != 0 {
+			return errors.New("elasticsearch write data not all success")
 		}
-		return errors.New("elasticsearch write data not all success")
 	}
 	return nil
 }
 
 func (e *ElasticsearchEgress) Stop() {
+	e.closeBulk()
+}
+
+// drain and close all bulk indexers, the new bulk indexer is created when next use
+func (e *ElasticsearchEgress) closeBulk() {
+	e.lock.Lock()
+	bulks := e.bulk
+	e.bulk = make(map[string]esutil.BulkIndexer)
+	e.lock.Unlock()
+	// close the bulk indexers after the lock is released, OnError of bulk indexer require the lock
+	for pipeline, bulk := range bulks {
+		if err := bulk.Close(e.ctx); err != nil {
+			util.GetLog().WithField("driver", e.driverName).
+				WithField("pipeline", pipeline).
+				WithField("error", err).
+				Errorf("elasticsearch close bulk indexer fail")
+		}
+	}
+}
 
+// get the bulk indexer of pipeline, create if not exist
+func (e *ElasticsearchEgress) getBulk(pipeline string) (esutil.BulkIndexer, error) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if bulk, ok := e.bulk[pipeline]; ok {
+		return bulk, nil
+	}
+	bulk, err := esutil.NewBulkIndexer(esutil.BulkIndexerConfig{
+		Client:        e.client,
+		FlushBytes:    e.FlushBytes,
+		FlushInterval: e.FlushInterval,
+		NumWorkers:    e.NumWorkers,
+		Pipeline:      pipeline,
+		// the request of a flush fail, the items of flush has no callback, so fail the writing batch
+		OnError: func(_ context.Context, err error) {
+			e.lock.Lock()
+			defer e.lock.Unlock()
+			if e.batch != nil {
+				e.batch.abort(err)
+			}
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	e.bulk[pipeline] = bulk
+	return bulk, nil
 }
 
-func (e *ElasticsearchEgress) isFailIgnore(req *esutil.BulkIndexerItem, resp *esutil.BulkIndexerResponseItem, err error) bool {
+func (e *ElasticsearchEgress) isFailIgnore(req *esutil.BulkIndexerItem, resp *esutil.BulkIndexerResponseItem, err error, ignoreMissing bool) bool {
 	errStr := ""
 	if err != nil {
 		errStr = err.Error()
@@ -186,74 +386,238 @@ func (e *ElasticsearchEgress) isFailIgnore(req *esutil.BulkIndexerItem, resp *es
 		WithField("result", resp.Result).
 		WithField("driver", e.driverName)
 
+	// ignore version conflict, the doc is newer than the item
+	if resp.Status == http.StatusConflict && e.ignoreConflict {
+		log.Warnf("elasticsearch version conflict, ignore the conflict fail")
+		return true
+	}
 	// ignore delete not exist doc
 	if req.Action == "delete" && resp.Status == 404 && e.ignoreDelete404 {
 		log.Warnf("elasticsearch delete a not exist doc, ignore the not found fail")
 		return true
 	}
+	// ignore update the not exist parent doc of nested child
+	if ignoreMissing && resp.Status == http.StatusNotFound {
+		log.Warnf("elasticsearch parent doc of nested child not exist, ignore the not found fail")
+		return true
+	}
 	log.Errorf("elasticsearch write data fail")
 	return false
 }
 
-// split data according table name
-func splitData(data []*driver.Data, idColumn map[string]string) map[string][]*esutil.BulkIndexerItem {
-	m := make(map[string][]*esutil.BulkIndexerItem)
-	for _, v := range data {
-		var (
-			table            = v.Table.Name
-			idColumnName, ok = idColumn[table]
-			idColumn         *driver.Column
-			_id              string
-		)
+// get the index option of data table, database.table first then table
+func (e *ElasticsearchEgress) indexOption(data *driver.Data) *esIndexOption {
+	if option, ok := e.indices[data.Database.Name+"."+data.Table.Name]; ok {
+		return option
+	}
+	if option, ok := e.indices[data.Table.Name]; ok {
+		return option
+	}
+	return e.defaultIndex
+}
+
+// create the index if not exist and add it to alias
+func (e *ElasticsearchEgress) ensureAlias(index, alias string) error {
+	if e.aliased[index] == alias {
+		return nil
+	}
+	resp, err := e.client.Indices.Create(index, e.client.Indices.Create.WithContext(e.ctx))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	// 400 is resource_already_exists_exception
+	if resp.IsError() && resp.StatusCode != http.StatusBadRequest {
+		return fmt.Errorf("create index return status code %d", resp.StatusCode)
+	}
+	resp, err = e.client.Indices.PutAlias([]string{index}, alias, e.client.Indices.PutAlias.WithContext(e.ctx))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.IsError() {
+		return fmt.Errorf("put alias return status code %d", resp.StatusCode)
+	}
+	e.aliased[index] = alias
+	return nil
+}
+
+// get the id columns of data table, database.table first then table
+func (e *ElasticsearchEgress) idColumnOf(data *driver.Data) ([]string, bool) {
+	if column, ok := e.idColumn[data.Database.Name+"."+data.Table.Name]; ok {
+		return column, true
+	}
+	column, ok := e.idColumn[data.Table.Name]
+	return column, ok
+}
+
+// build the doc id from id columns of row
+func (e *ElasticsearchEgress) docID(table string, row map[string]interface{}, idColumn []string) (string, error) {
+	ids := make([]string, 0, len(idColumn))
+	for _, c := range idColumn {
+		v, ok := row[c]
 		if !ok {
-			panic(fmt.Sprintf("id column of index %s not config", v.Table.Name))
+			return "", fmt.Errorf("id column `%s` not found in table %s", c, table)
 		}
-		_, ok = m[table]
-		if !ok {
-			m[table] = make([]*esutil.BulkIndexerItem, 0)
+		id, err := formatID(v)
+		if err != nil {
+			return "", fmt.Errorf("id column `%s` of table %s: %v", c, table, err)
 		}
+		ids = append(ids, id)
+	}
+	return strings.Join(ids, e.idSeparator), nil
+}
+
+// format id value to string, bytes is hex encoded and datetime is RFC3339 with nanosecond
+func formatID(v interface{}) (string, error) {
+	switch id := v.(type) {
+	case string:
+		return id, nil
+	case int, int8, int16, int32, int64:
+		return strconv.FormatInt(util.ConvertIntegerTo64(id).(int64), 10), nil
+	case uint, uint8, uint16, uint32, uint64:
+		return strconv.FormatUint(util.ConvertIntegerTo64(id).(uint64), 10), nil
+	case []byte:
+		return hex.EncodeToString(id), nil
+	case time.Time:
+		return id.Format(time.RFC3339Nano), nil
+	case nil:
+		return "", errors.New("id is null")
+	default:
+		return "", fmt.Errorf("unsupported id type %T", v)
+	}
+}
 
-		// get id column
-		for _, v := range v.Table.Column {
-			if v.Name == idColumnName {
-				idColumn = v
-				break
+// split data according ingest pipeline, also return map<concreteIndex>alias which need to add
+func (e *ElasticsearchEgress) splitData(data []*driver.Data) (map[string][]*esItem, map[string]string, error) {
+	var (
+		m       = make(map[string][]*esItem)
+		aliases = make(map[string]string)
+	)
+	for _, v := range data {
+		// child row write to the nested field of parent doc
+		if nested, ok := e.nestedOption(v); ok {
+			items, err := nested.items(e, v)
+			if err != nil {
+				return nil, nil, err
 			}
+			pipeline := e.indexOption(v).Pipeline
+			m[pipeline] = append(m[pipeline], items...)
+			continue
 		}
-		if idColumn == nil {
-			panic(fmt.Sprintf("id colunm `%s` not found", idColumnName))
+
+		var (
+			table                       = v.Table.Name
+			option                      = e.indexOption(v)
+			index, concreteIndex, alias = option.target(v)
+			pipeline                    = option.Pipeline
+		)
+		if alias != "" && concreteIndex != "" {
+			aliases[concreteIndex] = alias
 		}
 
-		// deep copy the rawMap , get id column as es _id.
-		rawMap := util.DeepCopyMap(v.RawMap)
+		// data stream is append only, doc id generate by elasticsearch
+		if option.DataStream {
+			if v.Event == driver.EventDelete {
+				util.GetLog().WithField("driver", e.driverName).
+					WithField("index", index).
+					Debugf("data stream ignore delete event")
+				continue
+			}
+			rawMap := util.DeepCopyMap(v.RawMap)
+			if _, ok := rawMap["@timestamp"]; !ok {
+				rawMap["@timestamp"] = option.dataTime(v)
+			}
+			b, _ := json.Marshal(rawMap)
+			item := &esutil.BulkIndexerItem{
+				Index:  index,
+				Action: "create",
+				Body:   bytes.NewReader(b),
+			}
+			if err := option.itemMeta(item, v); err != nil {
+				return nil, nil, err
+			}
+			m[pipeline] = append(m[pipeline], &esItem{BulkIndexerItem: *item})
+			continue
+		}
 
-		switch idColumn.Type {
-		case driver.ColumnTypeNumber:
-			_id = strconv.FormatInt(rawMap[idColumnName].(int64), 10)
-		case driver.ColumnTypeString:
-			_id = rawMap[idColumnName].(string)
-		default:
-			panic("id column type must string or number")
+		idColumn, ok := e.idColumnOf(v)
+		if !ok {
+			return nil, nil, fmt.Errorf("id column of table %s not config", table)
+		}
+		_id, err := e.docID(table, v.RawMap, idColumn)
+		if err != nil {
+			return nil, nil, err
 		}
+		rawMap := util.DeepCopyMap(v.RawMap)
 
+		var item *esutil.BulkIndexerItem
 		if v.Event == driver.EventDelete { // delete doc
-			m[table] = append(m[table], &esutil.BulkIndexerItem{
-				Index:      table,
+			item = &esutil.BulkIndexerItem{
+				Index:      index,
 				Action:     "delete",
 				DocumentID: _id,
 				Body:       bytes.NewReader([]byte{}),
-			})
+			}
 		} else { // insert or update doc
-			delete(rawMap, idColumnName)
-			b, _ := json.Marshal(rawMap)
-			m[table] = append(m[table], &esutil.BulkIndexerItem{
-				Index:      table,
-				Action:     "index",
+			for _, c := range idColumn {
+				delete(rawMap, c)
+			}
+			action, body, ok := option.docAction(v, rawMap)
+			if !ok {
+				continue
+			}
+			b, _ := json.Marshal(body)
+			item = &esutil.BulkIndexerItem{
+				Index:      index,
+				Action:     action,
 				DocumentID: _id,
 				Body:       bytes.NewReader(b),
-			})
+			}
+		}
+		if err := option.itemMeta(item, v); err != nil {
+			return nil, nil, err
 		}
+		m[pipeline] = append(m[pipeline], &esItem{BulkIndexerItem: *item})
 	}
 
-	return m
+	return m, aliases, nil
+}
+
+// esItem is a bulk item of data batch
+type esItem struct {
+	esutil.BulkIndexerItem
+	// ignore the 404 of update, the parent doc of nested child not exist
+	ignoreMissing bool
+}
+
+// esBatch track the items of a data batch in bulk indexer
+type esBatch struct {
+	pending int64
+	fail    uint64
+	ignore  uint64
+	finish  chan struct{}
+	err     chan error
+}
+
+func newEsBatch(total int) *esBatch {
+	return &esBatch{
+		pending: int64(total),
+		finish:  make(chan struct{}),
+		err:     make(chan error, 1),
+	}
+}
+
+// an item is success or fail
+func (b *esBatch) done() {
+	if atomic.AddInt64(&b.pending, -1) == 0 {
+		close(b.finish)
+	}
+}
+
+func (b *esBatch) abort(err error) {
+	select {
+	case b.err <- err:
+	default:
+	}
 }
@@ -0,0 +1,337 @@
+package elasticsearch
+
+import (
+	"fmt"
+	"github.com/elastic/go-elasticsearch/v8/esutil"
+	"github.com/enustah/db-canal/driver"
+	"github.com/enustah/db-canal/util"
+	"reflect"
+	"strings"
+	"time"
+)
+
+const (
+	defaultIndexTemplate = "{table}"
+
+	// insert and update write the whole row with index action
+	updateModeIndex = "index"
+	// update only write the changed columns with update action
+	updateModeUpdate = "update"
+
+	defaultScriptLang = "painless"
+
+	defaultVersionType = "external"
+)
+
+// elasticsearch date format token to go time layout, longer token first
+var dateTokenReplacer = strings.NewReplacer(
+	"yyyy", "2006",
+	"yy", "06",
+	"MM", "01",
+	"dd", "02",
+	"HH", "15",
+)
+
+type esIndexOption struct {
+	// index name template, default {table}. support {database}, {table} and date format like {yyyy.MM.dd}
+	Index string `mapstructure:"index"`
+	// the column to format the date in index name, value should be time.Time or unix second.
+	// default the event time of source, or now if source not provide
+	TimeColumn string `mapstructure:"timeColumn"`
+	// alias template, the index add to alias when first write
+	Alias string `mapstructure:"alias"`
+	// write to alias instead of index, the alias must have a write index. e.g. managed by ilm rollover
+	WriteAlias bool `mapstructure:"writeAlias"`
+	// index is a data stream, docs only append with create action and delete is ignored
+	DataStream bool `mapstructure:"dataStream"`
+	// index or update, default index. update mode send the changed columns of OldDataMap and RawMap
+	UpdateMode string `mapstructure:"updateMode"`
+	// update mode only, create the doc if not exist. insert event also use update action
+	DocAsUpsert bool `mapstructure:"docAsUpsert"`
+	// insert and update use the script to update doc
+	Script *esScriptOption `mapstructure:"script"`
+	// the column as routing value
+	RoutingColumn string `mapstructure:"routingColumn"`
+	// ingest pipeline of the doc
+	Pipeline string `mapstructure:"pipeline"`
+	// the column as doc version, value should be integer or time (in millisecond). only for index and delete action
+	VersionColumn string `mapstructure:"versionColumn"`
+	// external or external_gte, default external
+	VersionType string `mapstructure:"versionType"`
+
+	index *indexTemplate
+	alias *indexTemplate
+}
+
+/*
+esScriptOption is the script of update action. the params of script contain the static params and
+params.row (the row except id columns), params.old (the old row of update event, may be null) and params.event.
+*/
+type esScriptOption struct {
+	Source string `mapstructure:"source"`
+	// default painless
+	Lang   string                 `mapstructure:"lang"`
+	Params map[string]interface{} `mapstructure:"params"`
+	// run the script when doc not exist instead of insert upsert doc, the script should handle ctx.op
+	ScriptedUpsert bool `mapstructure:"scriptedUpsert"`
+}
+
+// indexTemplate is a parsed index name template
+type indexTemplate struct {
+	parts []indexTemplatePart
+}
+
+type indexTemplatePart struct {
+	// literal text, or token name when isToken is true
+	text    string
+	isToken bool
+	// go time layout of date token
+	layout string
+}
+
+func parseIndexTemplate(tmpl string) (*indexTemplate, error) {
+	t := &indexTemplate{}
+	for len(tmpl) != 0 {
+		start := strings.IndexByte(tmpl, '{')
+		if start < 0 {
+			t.parts = append(t.parts, indexTemplatePart{text: tmpl})
+			break
+		}
+		end := strings.IndexByte(tmpl[start:], '}')
+		if end < 0 {
+			return nil, fmt.Errorf("unclosed `{` in index template %s", tmpl)
+		}
+		end += start
+		if start != 0 {
+			t.parts = append(t.parts, indexTemplatePart{text: tmpl[:start]})
+		}
+		token := tmpl[start+1 : end]
+		part := indexTemplatePart{text: token, isToken: true}
+		if token != "database" && token != "table" {
+			part.layout = dateTokenReplacer.Replace(token)
+			if strings.ContainsAny(part.layout, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ") {
+				return nil, fmt.Errorf("unknown token {%s} in index template", token)
+			}
+		}
+		t.parts = append(t.parts, part)
+		tmpl = tmpl[end+1:]
+	}
+	return t, nil
+}
+
+func (t *indexTemplate) hasDate() bool {
+	for _, v := range t.parts {
+		if v.layout != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// render the index name, elasticsearch index name must be lowercase
+func (t *indexTemplate) render(data *driver.Data, tm time.Time) string {
+	var b strings.Builder
+	for _, v := range t.parts {
+		switch {
+		case !v.isToken:
+			b.WriteString(v.text)
+		case v.text == "database":
+			b.WriteString(data.Database.Name)
+		case v.text == "table":
+			b.WriteString(data.Table.Name)
+		default:
+			b.WriteString(tm.Format(v.layout))
+		}
+	}
+	return strings.ToLower(b.String())
+}
+
+func (o *esIndexOption) init() error {
+	var err error
+	if o.Index == "" {
+		o.Index = defaultIndexTemplate
+	}
+	if o.index, err = parseIndexTemplate(o.Index); err != nil {
+		return err
+	}
+	if o.Alias != "" {
+		if o.alias, err = parseIndexTemplate(o.Alias); err != nil {
+			return err
+		}
+	}
+	if o.WriteAlias && o.alias == nil {
+		return fmt.Errorf("writeAlias require alias")
+	}
+	if o.DataStream && o.alias != nil {
+		return fmt.Errorf("data stream not support alias")
+	}
+	switch o.UpdateMode {
+	case "":
+		o.UpdateMode = updateModeIndex
+	case updateModeIndex, updateModeUpdate:
+	default:
+		return fmt.Errorf("unknown update mode %s", o.UpdateMode)
+	}
+	if o.Script != nil {
+		if o.Script.Source == "" {
+			return fmt.Errorf("script source is empty")
+		}
+		if o.Script.Lang == "" {
+			o.Script.Lang = defaultScriptLang
+		}
+	}
+	if o.DataStream && (o.UpdateMode == updateModeUpdate || o.Script != nil) {
+		return fmt.Errorf("data stream not support update")
+	}
+	if o.VersionColumn != "" {
+		switch o.VersionType {
+		case "":
+			o.VersionType = defaultVersionType
+		case "external", "external_gte":
+		default:
+			return fmt.Errorf("unknown version type %s", o.VersionType)
+		}
+		if o.DataStream {
+			return fmt.Errorf("data stream not support version")
+		}
+	}
+	return nil
+}
+
+// get the time to format the date in index name
+func (o *esIndexOption) dataTime(data *driver.Data) time.Time {
+	return dataTime(data, o.TimeColumn)
+}
+
+// get the time of timeColumn, or the event time if timeColumn is empty or invalid, or now if source not provide
+func dataTime(data *driver.Data, timeColumn string) time.Time {
+	if timeColumn != "" {
+		switch v := data.RawMap[timeColumn].(type) {
+		case time.Time:
+			return v
+		case int64:
+			return time.Unix(v, 0)
+		case uint64:
+			return time.Unix(int64(v), 0)
+		default:
+			util.GetLog().WithField("table", data.Table.Name).
+				WithField("column", timeColumn).
+				Warnf("time column is not time or unix second, use event time instead")
+		}
+	}
+	if t, ok := data.Metadata[driver.MetadataEventTime].(time.Time); ok && !t.IsZero() {
+		return t
+	}
+	return time.Now()
+}
+
+// get the index to write and the concrete index to add alias, aliasName is empty if not need
+func (o *esIndexOption) target(data *driver.Data) (index, concreteIndex, aliasName string) {
+	var tm time.Time
+	if o.index.hasDate() || (o.alias != nil && o.alias.hasDate()) {
+		tm = o.dataTime(data)
+	}
+	if o.alias != nil {
+		aliasName = o.alias.render(data, tm)
+	}
+	if o.WriteAlias {
+		return aliasName, "", ""
+	}
+	index = o.index.render(data, tm)
+	return index, index, aliasName
+}
+
+/*
+get the bulk action and body of insert or update data. doc is the row except id columns.
+ok is false if nothing need to write, e.g. update without changed column.
+*/
+func (o *esIndexOption) docAction(data *driver.Data, doc map[string]interface{}) (action string, body interface{}, ok bool) {
+	if o.Script != nil {
+		params := make(map[string]interface{}, len(o.Script.Params)+3)
+		for k, v := range o.Script.Params {
+			params[k] = v
+		}
+		params["row"] = doc
+		params["old"] = data.OldDataMap
+		params["event"] = data.Event
+		b := map[string]interface{}{
+			"script": map[string]interface{}{
+				"source": o.Script.Source,
+				"lang":   o.Script.Lang,
+				"params": params,
+			},
+			"upsert": doc,
+		}
+		if o.Script.ScriptedUpsert {
+			b["scripted_upsert"] = true
+			b["upsert"] = map[string]interface{}{}
+		}
+		return "update", b, true
+	}
+
+	if o.UpdateMode != updateModeUpdate {
+		return "index", doc, true
+	}
+	if data.Event == driver.EventInsert {
+		if o.DocAsUpsert {
+			return "update", map[string]interface{}{"doc": doc, "doc_as_upsert": true}, true
+		}
+		return "index", doc, true
+	}
+
+	changed := doc
+	if data.OldDataMap != nil {
+		changed = make(map[string]interface{})
+		for k, v := range doc {
+			if old, exist := data.OldDataMap[k]; !exist || !reflect.DeepEqual(old, v) {
+				changed[k] = v
+			}
+		}
+		if len(changed) == 0 {
+			return "", nil, false
+		}
+	}
+	b := map[string]interface{}{"doc": changed}
+	if o.DocAsUpsert {
+		b["doc_as_upsert"] = true
+	}
+	return "update", b, true
+}
+
+// set routing and version of bulk item
+func (o *esIndexOption) itemMeta(item *esutil.BulkIndexerItem, data *driver.Data) error {
+	routing, err := o.routing(data.Table.Name, data.RawMap)
+	if err != nil {
+		return err
+	}
+	item.Routing = routing
+	// update action not support external version
+	if o.VersionColumn != "" && (item.Action == "index" || item.Action == "delete") {
+		var version int64
+		switch v := data.RawMap[o.VersionColumn].(type) {
+		case int64:
+			version = v
+		case uint64:
+			version = int64(v)
+		case time.Time:
+			version = v.UnixMilli()
+		default:
+			return fmt.Errorf("version column `%s` of table %s must be integer or time, got %T", o.VersionColumn, data.Table.Name, v)
+		}
+		item.Version = &version
+		item.VersionType = o.VersionType
+	}
+	return nil
+}
+
+// the routing value of row, empty if routingColumn not config
+func (o *esIndexOption) routing(table string, row map[string]interface{}) (string, error) {
+	if o.RoutingColumn == "" {
+		return "", nil
+	}
+	routing, err := formatID(row[o.RoutingColumn])
+	if err != nil {
+		return "", fmt.Errorf("routing column `%s` of table %s: %v", o.RoutingColumn, table, err)
+	}
+	return routing, nil
+}
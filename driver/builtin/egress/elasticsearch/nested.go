@@ -0,0 +1,145 @@
+package elasticsearch
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/elastic/go-elasticsearch/v8/esutil"
+	"github.com/enustah/db-canal/driver"
+	"time"
+)
+
+/*
+remove the element match params.match from nested array, then add params.row if not null.
+elements compare by params.key columns.
+*/
+const nestedScript = `if (ctx._source[params.field] == null) { ctx._source[params.field] = new ArrayList(); }
+if (params.match != null) {
+  ctx._source[params.field].removeIf(e -> { for (k in params.key) { if (e[k] != params.match[k]) { return false; } } return true; });
+}
+if (params.row != null) { ctx._source[params.field].add(params.row); }`
+
+// esNestedOption embed the row of child table into the nested field of parent doc
+type esNestedOption struct {
+	// parent index template, support the same token as index
+	ParentIndex string `mapstructure:"parentIndex"`
+	// columns of child row to build the parent doc id, join with idSeparator
+	ParentKey []string `mapstructure:"parentKey"`
+	// nested field of parent doc
+	Field string `mapstructure:"field"`
+	// columns to identify the child element in nested array
+	ChildKey []string `mapstructure:"childKey"`
+	// create the parent doc with only the nested field if not exist
+	Upsert bool `mapstructure:"upsert"`
+	// ignore the write fail when parent doc not exist and upsert is false
+	IgnoreMissingParent bool `mapstructure:"ignoreMissingParent"`
+
+	index *indexTemplate
+}
+
+func (o *esNestedOption) init() error {
+	var err error
+	if o.ParentIndex == "" || o.Field == "" || len(o.ParentKey) == 0 || len(o.ChildKey) == 0 {
+		return fmt.Errorf("parentIndex, parentKey, field and childKey is require")
+	}
+	o.index, err = parseIndexTemplate(o.ParentIndex)
+	return err
+}
+
+// the scripted update of a parent doc
+type nestedUpdate struct {
+	parentID string
+	// the row to get routing of parent doc
+	parent map[string]interface{}
+	// the element to remove and the row to add
+	match, row map[string]interface{}
+}
+
+/*
+convert child row change to scripted update of parent doc. the routing and pipeline of parent doc
+are the routingColumn of child row and pipeline in the index option of child table
+*/
+func (o *esNestedOption) items(e *ElasticsearchEgress, data *driver.Data) ([]*esItem, error) {
+	var tm time.Time
+	if o.index.hasDate() {
+		tm = dataTime(data, "")
+	}
+	var (
+		index   = o.index.render(data, tm)
+		option  = e.indexOption(data)
+		updates []nestedUpdate
+	)
+	parentID, err := e.docID(data.Table.Name, data.RawMap, o.ParentKey)
+	if err != nil {
+		return nil, err
+	}
+	switch data.Event {
+	case driver.EventInsert:
+		updates = []nestedUpdate{{parentID, data.RawMap, data.RawMap, data.RawMap}}
+	case driver.EventDelete:
+		updates = []nestedUpdate{{parentID, data.RawMap, data.RawMap, nil}}
+	case driver.EventUpdate:
+		if data.OldDataMap == nil {
+			updates = []nestedUpdate{{parentID, data.RawMap, data.RawMap, data.RawMap}}
+			break
+		}
+		oldParentID, err := e.docID(data.Table.Name, data.OldDataMap, o.ParentKey)
+		if err != nil {
+			return nil, err
+		}
+		// the child move to another parent, remove from the old parent
+		if oldParentID != parentID {
+			updates = []nestedUpdate{
+				{oldParentID, data.OldDataMap, data.OldDataMap, nil},
+				{parentID, data.RawMap, data.RawMap, data.RawMap},
+			}
+		} else {
+			updates = []nestedUpdate{{parentID, data.RawMap, data.OldDataMap, data.RawMap}}
+		}
+	}
+
+	items := make([]*esItem, 0, len(updates))
+	for _, u := range updates {
+		routing, err := option.routing(data.Table.Name, u.parent)
+		if err != nil {
+			return nil, err
+		}
+		body := map[string]interface{}{
+			"script": map[string]interface{}{
+				"source": nestedScript,
+				"lang":   defaultScriptLang,
+				"params": map[string]interface{}{
+					"field": o.Field,
+					"key":   o.ChildKey,
+					"match": u.match,
+					"row":   u.row,
+				},
+			},
+		}
+		if o.Upsert {
+			body["scripted_upsert"] = true
+			body["upsert"] = map[string]interface{}{}
+		}
+		b, _ := json.Marshal(body)
+		items = append(items, &esItem{
+			BulkIndexerItem: esutil.BulkIndexerItem{
+				Index:      index,
+				Action:     "update",
+				DocumentID: u.parentID,
+				Routing:    routing,
+				Body:       bytes.NewReader(b),
+			},
+			ignoreMissing: o.IgnoreMissingParent,
+		})
+	}
+	return items, nil
+}
+
+// get the nested option of data table, database.table first then table
+func (e *ElasticsearchEgress) nestedOption(data *driver.Data) (*esNestedOption, bool) {
+	if option, ok := e.nested[data.Database.Name+"."+data.Table.Name]; ok {
+		return option, true
+	}
+	option, ok := e.nested[data.Table.Name]
+	return option, ok
+}
@@ -0,0 +1,366 @@
+package file
+
+import (
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"github.com/enustah/db-canal/config"
+	"github.com/enustah/db-canal/driver"
+	"github.com/enustah/db-canal/register"
+	"github.com/enustah/db-canal/util"
+	"github.com/mitchellh/mapstructure"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+func init() {
+	util.Must(register.RegisterEgressDriver("file_egress", &FileEgress{}))
+}
+
+const (
+	formatJson = "json"
+	formatCsv  = "csv"
+
+	defaultPartition = "2006-01-02"
+	// column name of event in csv header
+	csvEventColumn = "_event"
+)
+
+type fileEgressOption struct {
+	// json: json lines, csv: csv with header. default json
+	Format string `mapstructure:"format"`
+	// go time layout of the partition directory, default 2006-01-02. the file path is
+	// <url>/<database>/<table>/<partition>/<create time>-<seq>.<ext>
+	Partition string `mapstructure:"partition"`
+	// rotate file when file size reach maxFileSize, in bytes. 0 means no limit
+	MaxFileSize int64 `mapstructure:"maxFileSize"`
+	// rotate file when file open longer than rotateInterval. e.g. 10m. empty means no limit
+	RotateInterval string `mapstructure:"rotateInterval"`
+	Gzip           bool   `mapstructure:"gzip"`
+}
+
+// fileRow is the json line of a row
+type fileRow struct {
+	Event    driver.Event           `json:"event"`
+	Database string                 `json:"database"`
+	Table    string                 `json:"table"`
+	Data     map[string]interface{} `json:"data"`
+	Old      map[string]interface{} `json:"old,omitempty"`
+}
+
+type FileEgress struct {
+	driverName     string
+	dir            string
+	format         string
+	partition      string
+	maxFileSize    int64
+	rotateInterval time.Duration
+	gzip           bool
+	// map<database/table>writer
+	writers map[string]*fileWriter
+	// increase on every new file, avoid file name conflict when rotate in one data batch
+	seq uint64
+}
+
+// fileWriter is the opened file of a table
+type fileWriter struct {
+	path      string
+	partition string
+	createAt  time.Time
+	file      *os.File
+	counter   *countWriter
+	gz        *gzip.Writer
+	w         io.Writer
+	csv       *csv.Writer
+	header    []string
+	closed    bool
+}
+
+type countWriter struct {
+	w    io.Writer
+	size int64
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.size += int64(n)
+	return n, err
+}
+
+func (f *FileEgress) Init(config config.EgressConfig) error {
+	option := &fileEgressOption{}
+	if err := mapstructure.Decode(config.Options, option); err != nil {
+		return err
+	}
+	switch option.Format {
+	case "":
+		option.Format = formatJson
+	case formatJson, formatCsv:
+	default:
+		return fmt.Errorf("unknown file format %s", option.Format)
+	}
+	if option.Partition == "" {
+		option.Partition = defaultPartition
+	}
+	if config.Url == "" {
+		return fmt.Errorf("file egress directory is empty")
+	}
+	var rotateInterval time.Duration
+	if option.RotateInterval != "" {
+		var err error
+		if rotateInterval, err = util.ParseTimeStr(option.RotateInterval); err != nil {
+			return err
+		}
+	}
+
+	f.driverName = config.Driver
+	f.dir = config.Url
+	f.format = option.Format
+	f.partition = option.Partition
+	f.maxFileSize = option.MaxFileSize
+	f.rotateInterval = rotateInterval
+	f.gzip = option.Gzip
+	f.writers = make(map[string]*fileWriter)
+	return nil
+}
+
+func (f *FileEgress) Start() error {
+	return os.MkdirAll(f.dir, 0755)
+}
+
+/*
+WriteData append data to files and fsync all touched files before return, so the save point
+only advance after data is durable. If WriteData fail halfway, rows already written will
+write again on retry.
+*/
+func (f *FileEgress) WriteData(dataBatch []*driver.Data) error {
+	var (
+		now     = time.Now()
+		touched = make(map[*fileWriter]struct{})
+	)
+	for _, v := range dataBatch {
+		w, err := f.getWriter(v, now)
+		if err != nil {
+			return err
+		}
+		if err = f.writeRow(w, v); err != nil {
+			return err
+		}
+		touched[w] = struct{}{}
+	}
+	for w := range touched {
+		// the file rotated in this data batch is already synced on close
+		if w.closed {
+			continue
+		}
+		if err := w.sync(); err != nil {
+			util.GetLog().WithField("driver", f.driverName).
+				WithField("file", w.path).
+				WithField("error", err).
+				Errorf("file sync fail")
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *FileEgress) Stop() {
+	for k, w := range f.writers {
+		if err := w.close(); err != nil {
+			util.GetLog().WithField("driver", f.driverName).
+				WithField("file", w.path).
+				WithField("error", err).
+				Errorf("file close fail")
+		}
+		delete(f.writers, k)
+	}
+}
+
+// get the writer of data table, rotate the file if need
+func (f *FileEgress) getWriter(data *driver.Data, now time.Time) (*fileWriter, error) {
+	var (
+		key       = filepath.Join(data.Database.Name, data.Table.Name)
+		partition = now.Format(f.partition)
+		header    []string
+	)
+	if f.format == formatCsv {
+		header = csvHeader(data.Table)
+	}
+	w, ok := f.writers[key]
+	if ok && !f.needRotate(w, partition, header, now) {
+		return w, nil
+	}
+	if ok {
+		if err := w.close(); err != nil {
+			return nil, err
+		}
+		delete(f.writers, key)
+	}
+
+	dir := filepath.Join(f.dir, key, partition)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	ext := "jsonl"
+	if f.format == formatCsv {
+		ext = "csv"
+	}
+	if f.gzip {
+		ext += ".gz"
+	}
+	f.seq++
+	path := filepath.Join(dir, fmt.Sprintf("%s-%d.%s", now.Format("20060102T150405.000000000"), f.seq, ext))
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return nil, err
+	}
+	// sync the directory, make sure the new file entry is durable
+	if err = syncDir(dir); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	w = &fileWriter{
+		path:      path,
+		partition: partition,
+		createAt:  now,
+		file:      file,
+		counter:   &countWriter{w: file},
+		header:    header,
+	}
+	w.w = w.counter
+	if f.gzip {
+		w.gz = gzip.NewWriter(w.counter)
+		w.w = w.gz
+	}
+	if f.format == formatCsv {
+		w.csv = csv.NewWriter(w.w)
+		if err = w.csv.Write(header); err != nil {
+			w.close()
+			return nil, err
+		}
+	}
+	util.GetLog().WithField("driver", f.driverName).
+		WithField("file", path).
+		Debugf("open new file")
+	f.writers[key] = w
+	return w, nil
+}
+
+func (f *FileEgress) needRotate(w *fileWriter, partition string, header []string, now time.Time) bool {
+	if w.partition != partition {
+		return true
+	}
+	if f.maxFileSize > 0 && w.counter.size >= f.maxFileSize {
+		return true
+	}
+	if f.rotateInterval > 0 && now.Sub(w.createAt) >= f.rotateInterval {
+		return true
+	}
+	// csv header can not change in one file
+	if f.format == formatCsv {
+		if len(header) != len(w.header) {
+			return true
+		}
+		for i := range header {
+			if header[i] != w.header[i] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (f *FileEgress) writeRow(w *fileWriter, data *driver.Data) error {
+	if f.format == formatCsv {
+		record := make([]string, 0, len(w.header))
+		record = append(record, string(data.Event))
+		for _, c := range w.header[1:] {
+			record = append(record, toString(data.RawMap[c]))
+		}
+		return w.csv.Write(record)
+	}
+	b, err := json.Marshal(&fileRow{
+		Event:    data.Event,
+		Database: data.Database.Name,
+		Table:    data.Table.Name,
+		Data:     data.RawMap,
+		Old:      data.OldDataMap,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = w.w.Write(append(b, '\n'))
+	return err
+}
+
+// flush buffered data and fsync the file
+func (w *fileWriter) sync() error {
+	if w.csv != nil {
+		w.csv.Flush()
+		if err := w.csv.Error(); err != nil {
+			return err
+		}
+	}
+	if w.gz != nil {
+		if err := w.gz.Flush(); err != nil {
+			return err
+		}
+	}
+	return w.file.Sync()
+}
+
+func (w *fileWriter) close() error {
+	w.closed = true
+	if w.csv != nil {
+		w.csv.Flush()
+	}
+	if w.gz != nil {
+		if err := w.gz.Close(); err != nil {
+			w.file.Close()
+			return err
+		}
+	}
+	if err := w.file.Sync(); err != nil {
+		w.file.Close()
+		return err
+	}
+	return w.file.Close()
+}
+
+func csvHeader(table *driver.Table) []string {
+	header := make([]string, 0, len(table.Column)+1)
+	header = append(header, csvEventColumn)
+	for _, c := range table.Column {
+		header = append(header, c.Name)
+	}
+	return header
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+func toString(v interface{}) string {
+	switch val := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return val
+	case []byte:
+		return base64.StdEncoding.EncodeToString(val)
+	case time.Time:
+		return val.Format(time.RFC3339Nano)
+	default:
+		return fmt.Sprintf("%v", val)
+	}
+}
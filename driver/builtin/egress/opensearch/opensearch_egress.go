@@ -0,0 +1,25 @@
+package opensearch
+
+import (
+	"github.com/enustah/db-canal/config"
+	"github.com/enustah/db-canal/driver/builtin/egress/elasticsearch"
+	"github.com/enustah/db-canal/register"
+	"github.com/enustah/db-canal/util"
+)
+
+func init() {
+	util.Must(register.RegisterEgressDriver("opensearch_egress", &OpensearchEgress{}))
+}
+
+/*
+OpensearchEgress write data to opensearch. the bulk api of opensearch is compatible with elasticsearch,
+so it reuse elasticsearch egress and accept the same options, except the product check of client is skipped.
+*/
+type OpensearchEgress struct {
+	elasticsearch.ElasticsearchEgress
+}
+
+func (o *OpensearchEgress) Init(config config.EgressConfig) error {
+	o.SkipProductCheck = true
+	return o.ElasticsearchEgress.Init(config)
+}
@@ -0,0 +1,762 @@
+package parquet
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/enustah/db-canal/config"
+	"github.com/enustah/db-canal/driver"
+	"github.com/enustah/db-canal/register"
+	"github.com/enustah/db-canal/util"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/mitchellh/mapstructure"
+	"github.com/xitongsys/parquet-go/writer"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+func init() {
+	util.Must(register.RegisterEgressDriver("parquet_egress", &ParquetEgress{}))
+}
+
+const (
+	stagingExt = ".jsonl"
+	parquetExt = ".parquet"
+	// column name of event in parquet file
+	eventColumn = "_event"
+	// the parallel number of parquet writer marshal
+	parquetNP = 1
+)
+
+type parquetEgressOption struct {
+	// directory to buffer rows before finalize to parquet file. default <url>/_staging
+	// for local output. require when output to s3
+	StagingDir string `mapstructure:"stagingDir"`
+	// finalize the file when it reach maxFileRows, 0 means no limit
+	MaxFileRows int `mapstructure:"maxFileRows"`
+	// finalize the file when it reach about maxFileSize bytes, 0 means no limit
+	MaxFileSize int64 `mapstructure:"maxFileSize"`
+	// finalize the file when it open longer than maxFileAge. e.g. 10m. empty means no limit
+	MaxFileAge string `mapstructure:"maxFileAge"`
+	// the follow option relate to s3 compatible storage, only use when url is s3://bucket/prefix
+	Endpoint  string `mapstructure:"endpoint"`
+	AccessKey string `mapstructure:"accessKey"`
+	SecretKey string `mapstructure:"secretKey"`
+	Region    string `mapstructure:"region"`
+	UseSSL    bool   `mapstructure:"useSSL"`
+}
+
+// the first line of staging file, describe the table of following rows
+type stagingHeader struct {
+	Database string          `json:"database"`
+	Table    string          `json:"table"`
+	Column   []stagingColumn `json:"column"`
+}
+
+type stagingColumn struct {
+	Name string            `json:"name"`
+	Type driver.ColumnType `json:"type"`
+}
+
+type stagingRow struct {
+	Event driver.Event           `json:"event"`
+	Data  map[string]interface{} `json:"data"`
+	// the column which value is []byte and marshal as base64 string
+	Bytes []string `json:"bytes,omitempty"`
+}
+
+// stagingFile buffer rows of a table on disk, it will convert to parquet file when finalize
+type stagingFile struct {
+	path     string
+	header   *stagingHeader
+	createAt time.Time
+	file     *os.File
+	w        *bufio.Writer
+	rows     int
+	// bytes written include the header
+	size int64
+}
+
+// the position of staging file before a batch, the rows of fail batch rollback to here
+type stagingMark struct {
+	rows int
+	size int64
+}
+
+/*
+ParquetEgress buffer rows per table in local staging files and finalize them to parquet files
+when a file reach maxFileRows, maxFileSize or maxFileAge.
+
+the staging files are synced to disk before WriteData return, so the acknowledged rows are durable,
+and the staging files left by last run are committed on Start. the files reach threshold in a batch
+are committed after all rows of the batch are synced, and the rows of a fail batch are removed from
+the staging files, so the retry of the batch does not write the rows twice.
+*/
+type ParquetEgress struct {
+	driverName  string
+	outputDir   string
+	bucket      string
+	prefix      string
+	stagingDir  string
+	maxFileRows int
+	maxFileSize int64
+	maxFileAge  time.Duration
+	s3          *minio.Client
+
+	ctx        context.Context
+	cancelFunc func()
+	lock       *sync.Mutex
+	seq        uint64
+	// map<database/table>stagingFile
+	staging map[string]*stagingFile
+	// the closed staging files which commit fail, commit again before next batch
+	pending []string
+}
+
+func (p *ParquetEgress) Init(config config.EgressConfig) error {
+	option := &parquetEgressOption{}
+	if err := mapstructure.Decode(config.Options, option); err != nil {
+		return err
+	}
+
+	u, err := url.Parse(config.Url)
+	if err != nil {
+		return err
+	}
+	if u.Scheme == "s3" {
+		if option.StagingDir == "" {
+			return fmt.Errorf("stagingDir is require when output to s3")
+		}
+		p.bucket = u.Host
+		p.prefix = strings.Trim(u.Path, "/")
+		p.s3, err = minio.New(option.Endpoint, &minio.Options{
+			Creds:  credentials.NewStaticV4(option.AccessKey, option.SecretKey, ""),
+			Secure: option.UseSSL,
+			Region: option.Region,
+		})
+		if err != nil {
+			return err
+		}
+	} else {
+		if config.Url == "" {
+			return fmt.Errorf("parquet egress output directory is empty")
+		}
+		p.outputDir = config.Url
+		p.s3 = nil
+		if option.StagingDir == "" {
+			option.StagingDir = filepath.Join(config.Url, "_staging")
+		}
+	}
+	var maxFileAge time.Duration
+	if option.MaxFileAge != "" {
+		if maxFileAge, err = util.ParseTimeStr(option.MaxFileAge); err != nil {
+			return err
+		}
+	}
+
+	p.driverName = config.Driver
+	p.stagingDir = option.StagingDir
+	p.maxFileRows = option.MaxFileRows
+	p.maxFileSize = option.MaxFileSize
+	p.maxFileAge = maxFileAge
+	p.lock = &sync.Mutex{}
+	p.staging = make(map[string]*stagingFile)
+	p.pending = nil
+	return nil
+}
+
+func (p *ParquetEgress) Start() error {
+	p.ctx, p.cancelFunc = context.WithCancel(context.Background())
+	if err := os.MkdirAll(p.stagingDir, 0755); err != nil {
+		return err
+	}
+	if p.s3 != nil {
+		ok, err := p.s3.BucketExists(p.ctx, p.bucket)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fmt.Errorf("bucket %s not exist", p.bucket)
+		}
+	}
+	if err := p.recover(); err != nil {
+		return err
+	}
+	if p.maxFileAge > 0 {
+		go p.ageLoop(p.ctx)
+	}
+	return nil
+}
+
+func (p *ParquetEgress) WriteData(dataBatch []*driver.Data) (err error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	// the rows of last batch are acknowledged, the files of them should commit first
+	if err = p.commitPending(); err != nil {
+		return err
+	}
+
+	var (
+		now     = time.Now()
+		saved   = make(map[string]*stagingFile, len(p.staging))
+		marks   = make(map[*stagingFile]stagingMark, len(p.staging))
+		touched = make(map[*stagingFile]struct{})
+		// the files reach threshold, commit after all rows of the batch are synced
+		ready []*stagingFile
+	)
+	for k, s := range p.staging {
+		saved[k] = s
+		marks[s] = stagingMark{rows: s.rows, size: s.size}
+	}
+	// the batch is not acknowledged when fail and the canal will write it again
+	defer func() {
+		if err != nil {
+			p.rollback(saved, marks, touched)
+		}
+	}()
+
+	for _, v := range dataBatch {
+		s, replaced, err := p.getStaging(v, now)
+		if err != nil {
+			return err
+		}
+		if replaced != nil {
+			ready = append(ready, replaced)
+		}
+		touched[s] = struct{}{}
+		if err = s.append(v); err != nil {
+			return err
+		}
+		if p.reachLimit(s, now) {
+			delete(p.staging, stagingKey(s.header))
+			ready = append(ready, s)
+		}
+	}
+	for s := range touched {
+		if err = s.sync(); err != nil {
+			return err
+		}
+	}
+	if len(touched) > len(marks) {
+		// the new file entry should be durable
+		if err = syncDir(p.stagingDir); err != nil {
+			return err
+		}
+	}
+
+	// the rows are durable now, the file commit fail is pending and not fail the batch
+	for _, s := range ready {
+		p.finalize(s)
+	}
+	return nil
+}
+
+func (p *ParquetEgress) Stop() {
+	// wait the writing batch and commit the staging files before cancel the upload
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for key, s := range p.staging {
+		delete(p.staging, key)
+		p.finalize(s)
+	}
+	if err := p.commitPending(); err != nil {
+		util.GetLog().WithField("driver", p.driverName).
+			WithField("error", err).
+			Errorf("parquet file commit fail, commit again on next start")
+	}
+	p.cancelFunc()
+}
+
+// finalize the staging files open longer than maxFileAge
+func (p *ParquetEgress) ageLoop(ctx context.Context) {
+	ticker := time.NewTicker(p.maxFileAge / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			p.lock.Lock()
+			// the staging files are synced between batches
+			if err := p.commitPending(); err == nil {
+				for key, s := range p.staging {
+					if now.Sub(s.createAt) >= p.maxFileAge {
+						delete(p.staging, key)
+						p.finalize(s)
+					}
+				}
+			}
+			p.lock.Unlock()
+		}
+	}
+}
+
+// commit the staging files left by last run, the rows of them may be acknowledged.
+// the parquet files left are created from the staging files and removed
+func (p *ParquetEgress) recover() error {
+	files, err := filepath.Glob(filepath.Join(p.stagingDir, "*"+parquetExt))
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if err = os.Remove(f); err != nil {
+			return err
+		}
+	}
+	if files, err = filepath.Glob(filepath.Join(p.stagingDir, "*"+stagingExt)); err != nil {
+		return err
+	}
+	for _, f := range files {
+		ok, err := trimStaging(f)
+		if err != nil {
+			return err
+		}
+		if ok {
+			util.GetLog().WithField("driver", p.driverName).
+				WithField("file", f).
+				Infof("commit parquet staging file left by last run")
+			p.pending = append(p.pending, f)
+		}
+	}
+	if err = p.commitPending(); err != nil {
+		util.GetLog().WithField("driver", p.driverName).
+			WithField("error", err).
+			Errorf("parquet file commit fail, commit again before next batch")
+	}
+	return nil
+}
+
+// remove the incomplete last line of staging file when exit unexpectedly.
+// the file without complete header is removed and return false
+func trimStaging(path string) (bool, error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	var (
+		r    = bufio.NewReader(f)
+		end  int64
+		size int64
+	)
+	for {
+		line, err := r.ReadBytes('\n')
+		size += int64(len(line))
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return false, err
+		}
+		end = size
+	}
+	if end == 0 {
+		return false, os.Remove(path)
+	}
+	if end < size {
+		if err = f.Truncate(end); err != nil {
+			return false, err
+		}
+		return true, f.Sync()
+	}
+	return true, nil
+}
+
+// rollback the staging files to the position before the fail batch
+func (p *ParquetEgress) rollback(saved map[string]*stagingFile, marks map[*stagingFile]stagingMark, touched map[*stagingFile]struct{}) {
+	for s := range touched {
+		m, ok := marks[s]
+		if !ok {
+			// created in the batch
+			s.file.Close()
+			os.Remove(s.path)
+			continue
+		}
+		if err := s.truncate(m); err != nil {
+			// the rows of fail batch may write twice, but the acknowledged rows are not lost
+			util.GetLog().WithField("driver", p.driverName).
+				WithField("file", s.path).
+				WithField("error", err).
+				Errorf("parquet staging file rollback fail, commit it with the rows of fail batch")
+			delete(saved, stagingKey(s.header))
+			s.file.Close()
+			p.pending = append(p.pending, s.path)
+		}
+	}
+	p.staging = saved
+}
+
+// commit the pending staging files in order
+func (p *ParquetEgress) commitPending() error {
+	for len(p.pending) > 0 {
+		if err := p.commit(p.pending[0]); err != nil {
+			return err
+		}
+		p.pending = p.pending[1:]
+	}
+	return nil
+}
+
+func (p *ParquetEgress) reachLimit(s *stagingFile, now time.Time) bool {
+	return (p.maxFileRows > 0 && s.rows >= p.maxFileRows) ||
+		(p.maxFileSize > 0 && s.size >= p.maxFileSize) ||
+		(p.maxFileAge > 0 && now.Sub(s.createAt) >= p.maxFileAge)
+}
+
+func stagingKey(header *stagingHeader) string {
+	return header.Database + "/" + header.Table
+}
+
+// get the staging file of data table, the file of old columns is replaced and return
+func (p *ParquetEgress) getStaging(data *driver.Data, now time.Time) (s *stagingFile, replaced *stagingFile, err error) {
+	header := &stagingHeader{
+		Database: data.Database.Name,
+		Table:    data.Table.Name,
+		Column:   make([]stagingColumn, 0, len(data.Table.Column)),
+	}
+	for _, c := range data.Table.Column {
+		header.Column = append(header.Column, stagingColumn{Name: c.Name, Type: c.Type})
+	}
+
+	key := stagingKey(header)
+	s, ok := p.staging[key]
+	if ok && sameColumn(s.header.Column, header.Column) {
+		return s, nil, nil
+	}
+	// parquet schema can not change in one file
+	if ok {
+		replaced = s
+		delete(p.staging, key)
+	}
+
+	p.seq++
+	name := fmt.Sprintf("%d-%d%s", now.UnixNano(), p.seq, stagingExt)
+	s = &stagingFile{
+		path:     filepath.Join(p.stagingDir, name),
+		header:   header,
+		createAt: now,
+	}
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return nil, nil, err
+	}
+	s.file = f
+	s.w = bufio.NewWriter(f)
+	b, _ := json.Marshal(header)
+	n, err := s.w.Write(append(b, '\n'))
+	if err != nil {
+		f.Close()
+		os.Remove(s.path)
+		return nil, nil, err
+	}
+	s.size = int64(n)
+	p.staging[key] = s
+	return s, replaced, nil
+}
+
+func (s *stagingFile) append(data *driver.Data) error {
+	row := &stagingRow{
+		Event: data.Event,
+		Data:  data.RawMap,
+	}
+	for k, v := range data.RawMap {
+		if _, ok := v.([]byte); ok {
+			row.Bytes = append(row.Bytes, k)
+		}
+	}
+	b, err := json.Marshal(row)
+	if err != nil {
+		return err
+	}
+	// the row can not convert make the commit of staging file fail forever, check it before write
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	decoder.UseNumber()
+	check := &stagingRow{}
+	if err = decoder.Decode(check); err != nil {
+		return err
+	}
+	if _, err = parquetRecord(s.header, check); err != nil {
+		return err
+	}
+	n, err := s.w.Write(append(b, '\n'))
+	s.size += int64(n)
+	s.rows++
+	return err
+}
+
+func (s *stagingFile) sync() error {
+	if err := s.w.Flush(); err != nil {
+		return err
+	}
+	return s.file.Sync()
+}
+
+// drop the rows written after the mark
+func (s *stagingFile) truncate(m stagingMark) error {
+	s.w.Reset(s.file)
+	if err := s.file.Truncate(m.size); err != nil {
+		return err
+	}
+	if _, err := s.file.Seek(m.size, io.SeekStart); err != nil {
+		return err
+	}
+	s.rows, s.size = m.rows, m.size
+	return nil
+}
+
+// close the staging file and commit it, the file commit fail is pending to commit again
+func (p *ParquetEgress) finalize(s *stagingFile) {
+	err := s.w.Flush()
+	if cerr := s.file.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = p.commit(s.path)
+	}
+	if err != nil {
+		util.GetLog().WithField("driver", p.driverName).
+			WithField("file", s.path).
+			WithField("error", err).
+			Errorf("parquet file commit fail, commit again before next batch")
+		p.pending = append(p.pending, s.path)
+	}
+}
+
+// commit convert staging file to parquet file, then move it to output directory or upload to s3.
+// the staging file is removed at last. the name of parquet file is same when commit again
+func (p *ParquetEgress) commit(stagingPath string) (err error) {
+	var (
+		base        = strings.TrimSuffix(filepath.Base(stagingPath), stagingExt)
+		parquetPath = strings.TrimSuffix(stagingPath, stagingExt) + parquetExt
+	)
+	defer func() {
+		if err != nil {
+			os.Remove(parquetPath)
+		}
+	}()
+	header, rows, err := convertToParquet(stagingPath, parquetPath)
+	if err != nil {
+		return err
+	}
+	if rows != 0 {
+		if p.s3 != nil {
+			object := path.Join(p.prefix, header.Database, header.Table, base+parquetExt)
+			if _, err = p.s3.FPutObject(p.ctx, p.bucket, object, parquetPath, minio.PutObjectOptions{
+				ContentType: "application/octet-stream",
+			}); err != nil {
+				return err
+			}
+			if err = os.Remove(parquetPath); err != nil {
+				return err
+			}
+		} else {
+			dir := filepath.Join(p.outputDir, header.Database, header.Table)
+			if err = os.MkdirAll(dir, 0755); err != nil {
+				return err
+			}
+			if err = os.Rename(parquetPath, filepath.Join(dir, base+parquetExt)); err != nil {
+				return err
+			}
+			if err = syncDir(dir); err != nil {
+				return err
+			}
+		}
+	} else {
+		os.Remove(parquetPath)
+	}
+	util.GetLog().WithField("driver", p.driverName).
+		WithField("database", header.Database).
+		WithField("table", header.Table).
+		WithField("rows", rows).
+		Debugf("parquet file commit")
+	return os.Remove(stagingPath)
+}
+
+// read staging file and write rows to parquet file, return the header and rows count
+func convertToParquet(stagingPath, parquetPath string) (*stagingHeader, int, error) {
+	in, err := os.Open(stagingPath)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer in.Close()
+	decoder := json.NewDecoder(in)
+	decoder.UseNumber()
+	header := &stagingHeader{}
+	if err = decoder.Decode(header); err != nil {
+		return nil, 0, fmt.Errorf("read staging file %s header fail: %v", stagingPath, err)
+	}
+
+	out, err := os.Create(parquetPath)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer out.Close()
+	pw, err := writer.NewCSVWriterFromWriter(parquetSchema(header.Column), out, parquetNP)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	rows := 0
+	for {
+		row := &stagingRow{}
+		if err = decoder.Decode(row); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, 0, fmt.Errorf("read staging file %s fail: %v", stagingPath, err)
+		}
+		record, err := parquetRecord(header, row)
+		if err != nil {
+			return nil, 0, err
+		}
+		if err = pw.Write(record); err != nil {
+			return nil, 0, err
+		}
+		rows++
+	}
+	if err = pw.WriteStop(); err != nil {
+		return nil, 0, err
+	}
+	return header, rows, out.Sync()
+}
+
+// the values of row in order of header column, the first is event
+func parquetRecord(header *stagingHeader, row *stagingRow) ([]interface{}, error) {
+	bytesColumn := make(map[string]bool, len(row.Bytes))
+	for _, c := range row.Bytes {
+		bytesColumn[c] = true
+	}
+	record := make([]interface{}, 0, len(header.Column)+1)
+	record = append(record, string(row.Event))
+	for _, c := range header.Column {
+		v, err := parquetValue(c.Type, row.Data[c.Name], bytesColumn[c.Name])
+		if err != nil {
+			return nil, fmt.Errorf("convert column %s fail: %v", c.Name, err)
+		}
+		record = append(record, v)
+	}
+	return record, nil
+}
+
+// parquet schema derive from column type. all column are optional, since RawMap value may be nil
+func parquetSchema(column []stagingColumn) []string {
+	md := make([]string, 0, len(column)+1)
+	md = append(md, fmt.Sprintf("name=%s, type=BYTE_ARRAY, convertedtype=UTF8, repetitiontype=REQUIRED", eventColumn))
+	for _, c := range column {
+		var typ string
+		switch c.Type {
+		case driver.ColumnTypeNumber:
+			typ = "type=INT64"
+		case driver.ColumnTypeFloat:
+			typ = "type=DOUBLE"
+		case driver.ColumnDatetime:
+			typ = "type=INT64, convertedtype=TIMESTAMP_MILLIS"
+		case driver.ColumnTypeBytes:
+			typ = "type=BYTE_ARRAY"
+		default:
+			// string, enum, and struct or unknown as json string
+			typ = "type=BYTE_ARRAY, convertedtype=UTF8"
+		}
+		md = append(md, fmt.Sprintf("name=%s, %s, repetitiontype=OPTIONAL", c.Name, typ))
+	}
+	return md
+}
+
+// convert the value decode from staging file to parquet value, isBytes means the value is []byte as base64 string
+func parquetValue(typ driver.ColumnType, v interface{}, isBytes bool) (interface{}, error) {
+	if v == nil {
+		return nil, nil
+	}
+	if s, ok := v.(string); ok && isBytes {
+		b, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			return nil, err
+		}
+		v = string(b)
+	}
+	switch typ {
+	case driver.ColumnTypeNumber:
+		n, err := jsonNumber(v)
+		if err != nil {
+			return nil, err
+		}
+		if i, err := n.Int64(); err == nil {
+			return i, nil
+		}
+		// uint64 out of int64 range
+		u, err := strconv.ParseUint(n.String(), 10, 64)
+		return int64(u), err
+	case driver.ColumnTypeFloat:
+		n, err := jsonNumber(v)
+		if err != nil {
+			return nil, err
+		}
+		return n.Float64()
+	case driver.ColumnDatetime:
+		switch val := v.(type) {
+		case string:
+			t, err := time.Parse(time.RFC3339Nano, val)
+			if err != nil {
+				return nil, err
+			}
+			return t.UnixMilli(), nil
+		case json.Number:
+			// already convert to unix millisecond by hook
+			return val.Int64()
+		}
+		return nil, fmt.Errorf("can not convert %v to timestamp", v)
+	case driver.ColumnTypeBytes, driver.ColumnTypeString, driver.ColumnTypeEnum:
+		if s, ok := v.(string); ok {
+			return s, nil
+		}
+	}
+	b, err := json.Marshal(v)
+	return string(b), err
+}
+
+// the number value may be changed to string by hook
+func jsonNumber(v interface{}) (json.Number, error) {
+	switch val := v.(type) {
+	case json.Number:
+		return val, nil
+	case string:
+		n := json.Number(strings.TrimSpace(val))
+		if _, err := n.Float64(); err != nil {
+			return "", fmt.Errorf("can not convert %s to number", val)
+		}
+		return n, nil
+	}
+	return "", fmt.Errorf("can not convert %v to number", v)
+}
+
+func sameColumn(a, b []stagingColumn) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
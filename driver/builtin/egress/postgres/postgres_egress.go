@@ -0,0 +1,417 @@
+package postgres
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github.com/enustah/db-canal/config"
+	"github.com/enustah/db-canal/driver"
+	"github.com/enustah/db-canal/register"
+	"github.com/enustah/db-canal/util"
+	"github.com/lib/pq"
+	"github.com/mitchellh/mapstructure"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+func init() {
+	util.Must(register.RegisterEgressDriver("postgres_egress", &PostgresEgress{}))
+}
+
+// postgres limit the number of bind parameters in one statement
+const maxBindParam = math.MaxUint16
+
+type pgEgressOption struct {
+	// map<table_name or database.table_name>[]keyColumnName, require. use as ON CONFLICT target and delete condition,
+	// the target table must have a primary key or unique constraint on these columns
+	KeyColumn map[string][]string `mapstructure:"keyColumn"`
+	// target schema, default public
+	Schema string `mapstructure:"schema"`
+}
+
+type PostgresEgress struct {
+	driverName string
+	db         *sql.DB
+	schema     string
+	keyColumn  map[string][]string
+}
+
+// rows of one table in a data batch. only the final state of each key is preserved,
+// so upsert and delete are disjoint and can run in any order
+type pgTableBatch struct {
+	name    string
+	column  []*driver.Column
+	keys    []string
+	upsert  map[string]map[string]interface{}
+	delete  map[string][]interface{}
+	keyList []string // preserve the order of key first seen
+}
+
+func (p *PostgresEgress) Init(config config.EgressConfig) error {
+	option := &pgEgressOption{}
+	if err := mapstructure.Decode(config.Options, option); err != nil {
+		return err
+	}
+	for table, keys := range option.KeyColumn {
+		if len(keys) == 0 {
+			return fmt.Errorf("key column of table %s is empty", table)
+		}
+	}
+	if option.Schema == "" {
+		option.Schema = "public"
+	}
+
+	var err error
+	p.driverName = config.Driver
+	p.schema = option.Schema
+	p.keyColumn = option.KeyColumn
+	p.db, err = sql.Open("postgres", config.Url)
+	return err
+}
+
+func (p *PostgresEgress) Start() error {
+	return p.db.Ping()
+}
+
+func (p *PostgresEgress) WriteData(dataBatch []*driver.Data) error {
+	tables, err := p.splitData(dataBatch)
+	if err != nil {
+		return err
+	}
+	tx, err := p.db.Begin()
+	if err != nil {
+		return err
+	}
+	for i, t := range tables {
+		if err = p.deleteRows(tx, t); err != nil {
+			break
+		}
+		if err = p.upsertRows(tx, t, i); err != nil {
+			break
+		}
+	}
+	if err != nil {
+		util.GetLog().WithField("driver", p.driverName).
+			WithField("error", err).
+			Errorf("postgres write data fail, rollback")
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (p *PostgresEgress) Stop() {
+	p.db.Close()
+}
+
+// split data according database and table name, and compact rows to the final state of each key
+func (p *PostgresEgress) splitData(dataBatch []*driver.Data) ([]*pgTableBatch, error) {
+	var (
+		m     = make(map[string]*pgTableBatch)
+		order = make([]*pgTableBatch, 0)
+	)
+	for _, v := range dataBatch {
+		if v.Event != driver.EventInsert && v.Event != driver.EventUpdate && v.Event != driver.EventDelete {
+			continue
+		}
+		// the same table name of different database is not merged
+		name := v.Database.Name + "." + v.Table.Name
+		t, ok := m[name]
+		if !ok {
+			keys, ok := p.keyColumn[name]
+			if !ok {
+				keys, ok = p.keyColumn[v.Table.Name]
+			}
+			if !ok {
+				return nil, fmt.Errorf("key column of table %s not config", v.Table.Name)
+			}
+			t = &pgTableBatch{
+				name:   v.Table.Name,
+				keys:   keys,
+				upsert: make(map[string]map[string]interface{}),
+				delete: make(map[string][]interface{}),
+			}
+			m[name] = t
+			order = append(order, t)
+		}
+		t.mergeColumn(v.Table.Column)
+
+		key, keyVal, err := t.rowKey(v.RawMap)
+		if err != nil {
+			return nil, err
+		}
+		// key changed by update, the old row must be deleted
+		if v.Event == driver.EventUpdate && v.OldDataMap != nil {
+			if oldKey, oldKeyVal, err := t.rowKey(v.OldDataMap); err == nil && oldKey != key {
+				t.setDelete(oldKey, oldKeyVal)
+			}
+		}
+		if v.Event == driver.EventDelete {
+			t.setDelete(key, keyVal)
+		} else {
+			t.setUpsert(key, v.RawMap)
+		}
+	}
+	return order, nil
+}
+
+func (t *pgTableBatch) mergeColumn(column []*driver.Column) {
+	for _, c := range column {
+		found := false
+		for _, e := range t.column {
+			if e.Name == c.Name {
+				found = true
+				break
+			}
+		}
+		if !found {
+			t.column = append(t.column, c)
+		}
+	}
+}
+
+func (t *pgTableBatch) rowKey(row map[string]interface{}) (string, []interface{}, error) {
+	var (
+		keyStr = make([]string, 0, len(t.keys))
+		keyVal = make([]interface{}, 0, len(t.keys))
+	)
+	for _, k := range t.keys {
+		v, ok := row[k]
+		if !ok {
+			return "", nil, fmt.Errorf("key column %s not found in table %s", k, t.name)
+		}
+		keyStr = append(keyStr, fmt.Sprintf("%v", v))
+		keyVal = append(keyVal, v)
+	}
+	return strings.Join(keyStr, "\x00"), keyVal, nil
+}
+
+func (t *pgTableBatch) touch(key string) {
+	_, inUpsert := t.upsert[key]
+	_, inDelete := t.delete[key]
+	if !inUpsert && !inDelete {
+		t.keyList = append(t.keyList, key)
+	}
+}
+
+func (t *pgTableBatch) setDelete(key string, keyVal []interface{}) {
+	t.touch(key)
+	delete(t.upsert, key)
+	t.delete[key] = keyVal
+}
+
+func (t *pgTableBatch) setUpsert(key string, row map[string]interface{}) {
+	t.touch(key)
+	delete(t.delete, key)
+	t.upsert[key] = row
+}
+
+func (t *pgTableBatch) getColumn(name string) *driver.Column {
+	for _, c := range t.column {
+		if c.Name == name {
+			return c
+		}
+	}
+	return &driver.Column{Name: name, Type: driver.ColumnTypeUnknown}
+}
+
+func (p *PostgresEgress) tableIdentifier(table string) string {
+	return pq.QuoteIdentifier(p.schema) + "." + pq.QuoteIdentifier(table)
+}
+
+// delete rows by key, use `DELETE FROM t WHERE (k1,k2) IN (($1,$2),($3,$4)...)`
+func (p *PostgresEgress) deleteRows(tx *sql.Tx, t *pgTableBatch) error {
+	if len(t.delete) == 0 {
+		return nil
+	}
+	quoteKeys := make([]string, 0, len(t.keys))
+	for _, k := range t.keys {
+		quoteKeys = append(quoteKeys, pq.QuoteIdentifier(k))
+	}
+	var (
+		chunkSize = maxBindParam / len(t.keys)
+		tuples    = make([]string, 0, chunkSize)
+		args      = make([]interface{}, 0, chunkSize*len(t.keys))
+		flush     = func() error {
+			if len(tuples) == 0 {
+				return nil
+			}
+			_, err := tx.Exec(fmt.Sprintf("DELETE FROM %s WHERE (%s) IN (%s)",
+				p.tableIdentifier(t.name), strings.Join(quoteKeys, ","), strings.Join(tuples, ",")), args...)
+			tuples = tuples[:0]
+			args = args[:0]
+			return err
+		}
+	)
+	for _, key := range t.keyList {
+		keyVal, ok := t.delete[key]
+		if !ok {
+			continue
+		}
+		placeholder := make([]string, 0, len(keyVal))
+		for i, v := range keyVal {
+			args = append(args, convertValue(t.getColumn(t.keys[i]), v))
+			placeholder = append(placeholder, "$"+strconv.Itoa(len(args)))
+		}
+		tuples = append(tuples, "("+strings.Join(placeholder, ",")+")")
+		if len(tuples) >= chunkSize {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+	return flush()
+}
+
+/*
+upsert rows by COPY into a temp table, then `INSERT ... SELECT ... ON CONFLICT DO UPDATE`.
+the rows are grouped by the columns they have, so the column not in a row keep the value of existing row.
+*/
+func (p *PostgresEgress) upsertRows(tx *sql.Tx, t *pgTableBatch, seq int) error {
+	var (
+		groups = make(map[string][]map[string]interface{})
+		order  = make([]string, 0)
+		column = make(map[string][]*driver.Column)
+	)
+	for _, key := range t.keyList {
+		row, ok := t.upsert[key]
+		if !ok {
+			continue
+		}
+		var (
+			rowColumn = make([]*driver.Column, 0, len(t.column))
+			names     = make([]string, 0, len(t.column))
+		)
+		for _, c := range t.column {
+			if _, ok := row[c.Name]; ok {
+				rowColumn = append(rowColumn, c)
+				names = append(names, c.Name)
+			}
+		}
+		sig := strings.Join(names, "\x00")
+		if _, ok := groups[sig]; !ok {
+			order = append(order, sig)
+			column[sig] = rowColumn
+		}
+		groups[sig] = append(groups[sig], row)
+	}
+	for i, sig := range order {
+		// the temp table name is unique in the transaction and not longer than 63 bytes identifier limit
+		tmpTable := fmt.Sprintf("db_canal_tmp_%d_%d", seq, i)
+		if err := p.copyUpsert(tx, t, tmpTable, column[sig], groups[sig]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// upsert the rows which have the same columns
+func (p *PostgresEgress) copyUpsert(tx *sql.Tx, t *pgTableBatch, tmpTable string, rowColumn []*driver.Column, rows []map[string]interface{}) error {
+	var (
+		column      = make([]string, 0, len(rowColumn))
+		quoteColumn = make([]string, 0, len(rowColumn))
+		updateSet   = make([]string, 0, len(rowColumn))
+		quoteKeys   = make([]string, 0, len(t.keys))
+	)
+	for _, c := range rowColumn {
+		column = append(column, c.Name)
+		quoteColumn = append(quoteColumn, pq.QuoteIdentifier(c.Name))
+		isKey := false
+		for _, k := range t.keys {
+			if k == c.Name {
+				isKey = true
+				break
+			}
+		}
+		if !isKey {
+			updateSet = append(updateSet, fmt.Sprintf("%s=EXCLUDED.%s", pq.QuoteIdentifier(c.Name), pq.QuoteIdentifier(c.Name)))
+		}
+	}
+	for _, k := range t.keys {
+		quoteKeys = append(quoteKeys, pq.QuoteIdentifier(k))
+	}
+
+	if _, err := tx.Exec(fmt.Sprintf("CREATE TEMP TABLE %s (LIKE %s INCLUDING DEFAULTS) ON COMMIT DROP",
+		pq.QuoteIdentifier(tmpTable), p.tableIdentifier(t.name))); err != nil {
+		return err
+	}
+
+	stmt, err := tx.Prepare(pq.CopyIn(tmpTable, column...))
+	if err != nil {
+		return err
+	}
+	for _, row := range rows {
+		values := make([]interface{}, 0, len(rowColumn))
+		for _, c := range rowColumn {
+			values = append(values, convertValue(c, row[c.Name]))
+		}
+		if _, err = stmt.Exec(values...); err != nil {
+			stmt.Close()
+			return err
+		}
+	}
+	// flush copy data
+	if _, err = stmt.Exec(); err != nil {
+		stmt.Close()
+		return err
+	}
+	if err = stmt.Close(); err != nil {
+		return err
+	}
+
+	conflictAction := "DO NOTHING"
+	if len(updateSet) != 0 {
+		conflictAction = "DO UPDATE SET " + strings.Join(updateSet, ",")
+	}
+	_, err = tx.Exec(fmt.Sprintf("INSERT INTO %s (%s) SELECT %s FROM %s ON CONFLICT (%s) %s",
+		p.tableIdentifier(t.name),
+		strings.Join(quoteColumn, ","),
+		strings.Join(quoteColumn, ","),
+		pq.QuoteIdentifier(tmpTable),
+		strings.Join(quoteKeys, ","),
+		conflictAction,
+	))
+	return err
+}
+
+// convert RawMap value to the value which lib/pq can encode
+func convertValue(column *driver.Column, value interface{}) interface{} {
+	if value == nil {
+		return nil
+	}
+	switch column.Type {
+	case driver.ColumnTypeNumber:
+		switch reflect.ValueOf(value).Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+			reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			if u, ok := util.ConvertIntegerTo64(value).(uint64); ok {
+				// postgres has no unsigned type, pass as text to fit numeric column
+				if u > math.MaxInt64 {
+					return strconv.FormatUint(u, 10)
+				}
+				return int64(u)
+			}
+			return util.ConvertIntegerTo64(value)
+		}
+		return value
+	case driver.ColumnTypeEnum, driver.ColumnTypeString, driver.ColumnTypeFloat,
+		driver.ColumnTypeBytes, driver.ColumnDatetime:
+		return value
+	default:
+		// struct or unknown type, write as json to fit json/jsonb column
+		switch value.(type) {
+		case string, []byte:
+			return value
+		}
+		b, err := json.Marshal(value)
+		if err != nil {
+			util.GetLog().WithField("column", column.Name).
+				WithField("error", err).
+				Warnf("can not marshal value to json")
+			return fmt.Sprintf("%v", value)
+		}
+		return string(b)
+	}
+}
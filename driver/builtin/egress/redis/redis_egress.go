@@ -0,0 +1,202 @@
+package redis
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/enustah/db-canal/config"
+	"github.com/enustah/db-canal/driver"
+	"github.com/enustah/db-canal/register"
+	"github.com/enustah/db-canal/util"
+	"github.com/go-redis/redis/v8"
+	"github.com/mitchellh/mapstructure"
+	"regexp"
+	"strings"
+	"time"
+)
+
+func init() {
+	util.Must(register.RegisterEgressDriver("redis_egress", &RedisEgress{}))
+}
+
+const (
+	formatHash = "hash"
+	formatJson = "json"
+)
+
+var keyTemplateRe = regexp.MustCompile(`\{(\w+)\}`)
+
+type redisTableOption struct {
+	// key template, {column} will replace by the column value. e.g. user:{id}, require
+	Key string `mapstructure:"key"`
+	// hash or json, default hash
+	Format string `mapstructure:"format"`
+	// key expire time. e.g. 30s 10m. empty means never expire
+	TTL string `mapstructure:"ttl"`
+}
+
+type redisEgressOption struct {
+	// map<table_name>tableOption, require
+	Tables map[string]redisTableOption `mapstructure:"tables"`
+}
+
+type redisTable struct {
+	key       string
+	keyColumn []string
+	format    string
+	ttl       time.Duration
+}
+
+type RedisEgress struct {
+	driverName string
+	ctx        context.Context
+	client     *redis.Client
+	tables     map[string]*redisTable
+}
+
+func (r *RedisEgress) Init(config config.EgressConfig) error {
+	option := &redisEgressOption{}
+	if err := mapstructure.Decode(config.Options, option); err != nil {
+		return err
+	}
+	tables := make(map[string]*redisTable)
+	for name, o := range option.Tables {
+		t := &redisTable{
+			key:    o.Key,
+			format: o.Format,
+		}
+		for _, m := range keyTemplateRe.FindAllStringSubmatch(o.Key, -1) {
+			t.keyColumn = append(t.keyColumn, m[1])
+		}
+		if len(t.keyColumn) == 0 {
+			return fmt.Errorf("key template `%s` of table %s has no column", o.Key, name)
+		}
+		switch t.format {
+		case "":
+			t.format = formatHash
+		case formatHash, formatJson:
+		default:
+			return fmt.Errorf("unknown format %s of table %s", o.Format, name)
+		}
+		if o.TTL != "" {
+			var err error
+			if t.ttl, err = util.ParseTimeStr(o.TTL); err != nil {
+				return err
+			}
+		}
+		tables[name] = t
+	}
+
+	redisOption, err := redis.ParseURL(config.Url)
+	if err != nil {
+		return err
+	}
+	r.ctx = context.Background()
+	r.driverName = config.Driver
+	r.tables = tables
+	r.client = redis.NewClient(redisOption)
+	return nil
+}
+
+func (r *RedisEgress) Start() error {
+	return r.client.Ping(r.ctx).Err()
+}
+
+func (r *RedisEgress) WriteData(dataBatch []*driver.Data) error {
+	// validate all data before pipeline, so a bad row will not cause partial write
+	for _, v := range dataBatch {
+		if _, ok := r.tables[v.Table.Name]; !ok {
+			return fmt.Errorf("key template of table %s not config", v.Table.Name)
+		}
+	}
+	cmds, err := r.client.Pipelined(r.ctx, func(pipe redis.Pipeliner) error {
+		for _, v := range dataBatch {
+			t := r.tables[v.Table.Name]
+			key, err := t.buildKey(v.RawMap)
+			if err != nil {
+				return err
+			}
+			// key change by update, remove the old key
+			if v.Event == driver.EventUpdate && v.OldDataMap != nil {
+				if oldKey, err := t.buildKey(v.OldDataMap); err == nil && oldKey != key {
+					pipe.Del(r.ctx, oldKey)
+				}
+			}
+
+			switch v.Event {
+			case driver.EventDelete:
+				pipe.Del(r.ctx, key)
+			case driver.EventInsert, driver.EventUpdate:
+				if err = t.write(r.ctx, pipe, key, v.RawMap); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		for _, c := range cmds {
+			if c.Err() != nil {
+				util.GetLog().WithField("driver", r.driverName).
+					WithField("cmd", c.String()).
+					WithField("error", c.Err()).
+					Errorf("redis write data fail")
+			}
+		}
+	}
+	return err
+}
+
+func (r *RedisEgress) Stop() {
+	r.client.Close()
+}
+
+func (t *redisTable) buildKey(row map[string]interface{}) (string, error) {
+	key := t.key
+	for _, c := range t.keyColumn {
+		v, ok := row[c]
+		if !ok {
+			return "", fmt.Errorf("key column %s not found in row", c)
+		}
+		key = strings.ReplaceAll(key, "{"+c+"}", toString(v))
+	}
+	return key, nil
+}
+
+func (t *redisTable) write(ctx context.Context, pipe redis.Pipeliner, key string, row map[string]interface{}) error {
+	switch t.format {
+	case formatJson:
+		b, err := json.Marshal(row)
+		if err != nil {
+			return err
+		}
+		pipe.Set(ctx, key, b, t.ttl)
+	default:
+		// replace the whole hash, so column removed from the row will not remain
+		values := make(map[string]interface{}, len(row))
+		for k, v := range row {
+			values[k] = toString(v)
+		}
+		pipe.Del(ctx, key)
+		pipe.HSet(ctx, key, values)
+		if t.ttl > 0 {
+			pipe.Expire(ctx, key, t.ttl)
+		}
+	}
+	return nil
+}
+
+func toString(v interface{}) string {
+	switch val := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return val
+	case []byte:
+		return string(val)
+	case time.Time:
+		return val.Format(time.RFC3339)
+	default:
+		return fmt.Sprintf("%v", val)
+	}
+}
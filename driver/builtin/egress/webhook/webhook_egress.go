@@ -0,0 +1,178 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/enustah/db-canal/config"
+	"github.com/enustah/db-canal/driver"
+	"github.com/enustah/db-canal/register"
+	"github.com/enustah/db-canal/util"
+	"github.com/mitchellh/mapstructure"
+	"io"
+	"net/http"
+	"time"
+)
+
+func init() {
+	util.Must(register.RegisterEgressDriver("webhook_egress", &WebhookEgress{}))
+}
+
+const (
+	modeBatch  = "batch"
+	modeSingle = "single"
+
+	defaultSignatureHeader = "X-Signature"
+	defaultTimeout         = 10 * time.Second
+)
+
+type webhookEgressOption struct {
+	// batch: post the whole data batch as json array. single: post every row as json object. default batch
+	Mode    string            `mapstructure:"mode"`
+	Headers map[string]string `mapstructure:"headers"`
+	// hmac sha256 secret. if not empty, the signature of body will set to signatureHeader as `sha256=<hex>`
+	Secret          string `mapstructure:"secret"`
+	SignatureHeader string `mapstructure:"signatureHeader"`
+	// request timeout. e.g. 10s 1m, default 10s
+	Timeout string `mapstructure:"timeout"`
+}
+
+// webhookPayload is the json body of a row
+type webhookPayload struct {
+	Event    driver.Event           `json:"event"`
+	Database string                 `json:"database"`
+	Table    string                 `json:"table"`
+	Data     map[string]interface{} `json:"data"`
+	Old      map[string]interface{} `json:"old,omitempty"`
+}
+
+type WebhookEgress struct {
+	driverName      string
+	ctx             context.Context
+	client          *http.Client
+	url             string
+	mode            string
+	headers         map[string]string
+	secret          []byte
+	signatureHeader string
+}
+
+func (w *WebhookEgress) Init(config config.EgressConfig) error {
+	option := &webhookEgressOption{}
+	if err := mapstructure.Decode(config.Options, option); err != nil {
+		return err
+	}
+	switch option.Mode {
+	case "":
+		option.Mode = modeBatch
+	case modeBatch, modeSingle:
+	default:
+		return fmt.Errorf("unknown webhook mode %s", option.Mode)
+	}
+	if option.SignatureHeader == "" {
+		option.SignatureHeader = defaultSignatureHeader
+	}
+	timeout := defaultTimeout
+	if option.Timeout != "" {
+		var err error
+		if timeout, err = util.ParseTimeStr(option.Timeout); err != nil {
+			return err
+		}
+	}
+	if config.Url == "" {
+		return fmt.Errorf("webhook url is empty")
+	}
+
+	w.ctx = context.Background()
+	w.driverName = config.Driver
+	w.url = config.Url
+	w.mode = option.Mode
+	w.headers = option.Headers
+	w.secret = []byte(option.Secret)
+	w.signatureHeader = option.SignatureHeader
+	w.client = &http.Client{
+		Timeout: timeout,
+	}
+	return nil
+}
+
+func (w *WebhookEgress) Start() error {
+	return nil
+}
+
+func (w *WebhookEgress) WriteData(dataBatch []*driver.Data) error {
+	if w.mode == modeBatch {
+		payload := make([]*webhookPayload, 0, len(dataBatch))
+		for _, v := range dataBatch {
+			payload = append(payload, newWebhookPayload(v))
+		}
+		return w.post(payload)
+	}
+	// single mode. rows before the fail one are sent again on retry, receiver should be idempotent
+	for _, v := range dataBatch {
+		if err := w.post(newWebhookPayload(v)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *WebhookEgress) Stop() {
+	w.client.CloseIdleConnections()
+}
+
+func newWebhookPayload(data *driver.Data) *webhookPayload {
+	return &webhookPayload{
+		Event:    data.Event,
+		Database: data.Database.Name,
+		Table:    data.Table.Name,
+		Data:     data.RawMap,
+		Old:      data.OldDataMap,
+	}
+}
+
+// post body as json, non 2xx status code is treat as error, so canal will retry
+func (w *WebhookEgress) post(payload interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(w.ctx, http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range w.headers {
+		req.Header.Set(k, v)
+	}
+	if len(w.secret) != 0 {
+		req.Header.Set(w.signatureHeader, "sha256="+sign(w.secret, body))
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		util.GetLog().WithField("driver", w.driverName).
+			WithField("status", resp.StatusCode).
+			WithField("response", string(respBody)).
+			Errorf("webhook post fail")
+		return fmt.Errorf("webhook return status code %d", resp.StatusCode)
+	}
+	// drain body to reuse connection
+	io.Copy(io.Discard, resp.Body)
+	return nil
+}
+
+func sign(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
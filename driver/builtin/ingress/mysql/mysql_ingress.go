@@ -30,8 +30,8 @@ func init() {
 }
 
 const (
-	metadataTimeFmtStrKey = "time_fmt_str"
-	metadataEnumKey       = "enum"
+	metadataTimeFmtStrKey = driver.ColumnMetadataTimeFormat
+	metadataEnumKey       = driver.ColumnMetadataEnum
 )
 
 type mysqlEventHandler struct {
@@ -262,6 +262,10 @@ func convertRowEventToData(event *canal.RowsEvent, curLogName string) []*driver.
 		util.GetLog().WithField("event", event.Action).Warnf("get unknown event")
 		dataEvent = driver.EventUnknown
 	}
+	var eventTime time.Time
+	if event.Header != nil {
+		eventTime = time.Unix(int64(event.Header.Timestamp), 0)
+	}
 	var (
 		data        = make([]*driver.Data, 0, len(event.Rows))
 		convertRows = func(r []interface{}) map[string]interface{} {
@@ -283,7 +287,7 @@ func convertRowEventToData(event *canal.RowsEvent, curLogName string) []*driver.
 				RawMap:     convertRows(event.Rows[i+1]),
 				Table:      table,
 				Database:   database,
-				Metadata:   map[string]interface{}{},
+				Metadata:   map[string]interface{}{driver.MetadataEventTime: eventTime},
 			}
 			data = append(data, d)
 		}
@@ -294,7 +298,7 @@ func convertRowEventToData(event *canal.RowsEvent, curLogName string) []*driver.
 				RawMap:   convertRows(r),
 				Table:    table,
 				Database: database,
-				Metadata: map[string]interface{}{},
+				Metadata: map[string]interface{}{driver.MetadataEventTime: eventTime},
 			}
 			data = append(data, d)
 		}
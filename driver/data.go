@@ -25,6 +25,16 @@ const (
 	ColumnDatetime                      // RawMap value should return type of time.Time
 )
 
+const (
+	// Data.Metadata key of the time the event happen in source, value type is time.Time
+	MetadataEventTime = "eventTime"
+
+	// Column.Metadata key of enum values of ColumnTypeEnum, value type is []string
+	ColumnMetadataEnum = "enum"
+	// Column.Metadata key of the layout to parse string of ColumnDatetime, value type is string
+	ColumnMetadataTimeFormat = "time_fmt_str"
+)
+
 // the type which must implement deepCopy
 type deepCopyType interface {
 	*Database | *Table | *Column | *Data
@@ -87,11 +97,16 @@ type Data struct {
 }
 
 func (d *Data) DeepCopy() *Data {
+	var oldDataMap map[string]interface{}
+	if d.OldDataMap != nil {
+		oldDataMap = util.DeepCopyMap(d.OldDataMap)
+	}
 	return &Data{
-		Event:    d.Event,
-		RawMap:   util.DeepCopyMap(d.RawMap),
-		Table:    d.Table.DeepCopy(),
-		Database: d.Database.DeepCopy(),
-		Metadata: util.DeepCopyMap(d.Metadata),
+		Event:      d.Event,
+		OldDataMap: oldDataMap,
+		RawMap:     util.DeepCopyMap(d.RawMap),
+		Table:      d.Table.DeepCopy(),
+		Database:   d.Database.DeepCopy(),
+		Metadata:   util.DeepCopyMap(d.Metadata),
 	}
 }
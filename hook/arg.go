@@ -0,0 +1,321 @@
+package hook
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Arg int
+
+// Arg use to validate hook arg type, will cast to the go type in comment.
+const (
+	ArgTypeInt      Arg = iota // int64
+	ArgTypeStr                 // string
+	ArgTypeFloat               // float64
+	ArgTypeBool                // bool
+	ArgTypeDuration            // time.Duration, e.g. 1m30s
+	ArgTypeRegexp              // *regexp.Regexp
+	ArgTypeList                // []string, e.g. [a,b,c]
+)
+
+const (
+	// ArgVariadic flag the last arg accept one or more value, e.g. ArgTypeStr | ArgVariadic.
+	// the values flatten into the rest of HookFunc args
+	ArgVariadic Arg = 1 << 8
+	// ArgOptional flag the arg can be omitted, the HookFunc get the default value or nil.
+	// optional args must be the last. ArgOptional | ArgVariadic accept zero or more value
+	ArgOptional Arg = 1 << 9
+
+	argFlags = ArgVariadic | ArgOptional
+)
+
+// ArgSpec describe a hook arg, the arg can pass by name in key=value or structured form when Name is not empty
+type ArgSpec struct {
+	Name string
+	Type Arg
+	// default value of optional arg in string form
+	Default string
+}
+
+// rawArg is the arg of string form, quoted arg is always string and never treat as named arg
+type rawArg struct {
+	s      string
+	quoted bool
+}
+
+var namedArgRe = regexp.MustCompile(`^(\w+)\s*=([^=~].*)?$`)
+
+/*
+SplitArgs split the args of string form by comma, the comma inside quote, parentheses or
+brackets is not separator. e.g. filter(a in (1,2)) and columnInclude(db,table,[a,b])
+*/
+func SplitArgs(s string) []string {
+	var (
+		args  []string
+		depth int
+		quote byte
+		start int
+	)
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote != 0:
+			if c == '\\' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '(' || c == '[':
+			depth++
+		case c == ')' || c == ']':
+			depth--
+		case c == ',' && depth == 0:
+			args = append(args, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(args, s[start:])
+}
+
+/*
+unquote the arg which is a single quoted string, only \\, \" and \' are escaped so
+regexp like '\d+' keep the backslash.
+*/
+func unquote(s string) (string, bool) {
+	if len(s) < 2 || (s[0] != '"' && s[0] != '\'') || s[len(s)-1] != s[0] {
+		return s, false
+	}
+	var b strings.Builder
+	for i := 1; i < len(s)-1; i++ {
+		c := s[i]
+		if c == s[0] {
+			// quote in the middle, not a single string
+			return s, false
+		}
+		if c == '\\' && i+1 < len(s)-1 && (s[i+1] == '\\' || s[i+1] == '"' || s[i+1] == '\'') {
+			i++
+			c = s[i]
+		}
+		b.WriteByte(c)
+	}
+	return b.String(), true
+}
+
+func parseRawArg(s string) rawArg {
+	s = strings.TrimSpace(s)
+	if v, ok := unquote(s); ok {
+		return rawArg{s: v, quoted: true}
+	}
+	return rawArg{s: s}
+}
+
+func (h *Hook) spec(name string) (int, bool) {
+	for i, v := range h.args {
+		if v.Name == name {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// parse string form args to positional and named args
+func (h *Hook) parseStrArgs(args []string) (positional []interface{}, named map[string]interface{}, err error) {
+	for _, v := range args {
+		arg := parseRawArg(v)
+		if !arg.quoted {
+			if m := namedArgRe.FindStringSubmatch(arg.s); m != nil {
+				if _, ok := h.spec(m[1]); ok {
+					if named == nil {
+						named = make(map[string]interface{})
+					}
+					if _, exist := named[m[1]]; exist {
+						return nil, nil, HookArgErr{msg: fmt.Sprintf("hook %s arg %s repeat", h.name, m[1])}
+					}
+					named[m[1]] = parseRawArg(m[2])
+					continue
+				}
+			}
+		}
+		if len(named) != 0 {
+			return nil, nil, HookArgErr{msg: fmt.Sprintf("hook %s positional arg %s after named arg", h.name, v)}
+		}
+		positional = append(positional, arg)
+	}
+	return positional, named, nil
+}
+
+/*
+convertArgs match the positional and named args to arg spec and convert to the go type.
+arg value is rawArg of string form, or string, number, bool and list of structured form.
+*/
+func (h *Hook) convertArgs(positional []interface{}, named map[string]interface{}) ([]interface{}, error) {
+	errf := func(format string, a ...interface{}) error {
+		return HookArgErr{msg: fmt.Sprintf("hook %s ", h.name) + fmt.Sprintf(format, a...)}
+	}
+	for k := range named {
+		if _, ok := h.spec(k); !ok {
+			return nil, errf("unknown arg %s", k)
+		}
+	}
+
+	args := make([]interface{}, 0, len(h.args))
+	for i, spec := range h.args {
+		typ := spec.Type &^ argFlags
+		var values []interface{}
+		variadic := spec.Type&ArgVariadic != 0 && i == len(h.args)-1
+		if i < len(positional) {
+			if variadic {
+				values = positional[i:]
+			} else {
+				values = positional[i : i+1]
+			}
+		}
+		if v, ok := named[spec.Name]; ok && spec.Name != "" {
+			if len(values) != 0 {
+				return nil, errf("arg %s is set by position and name", spec.Name)
+			}
+			// list of structured form flatten to variadic arg
+			if l, isList := v.([]interface{}); isList && variadic {
+				values = l
+			} else {
+				values = []interface{}{v}
+			}
+		}
+
+		if len(values) == 0 {
+			if spec.Type&ArgOptional == 0 {
+				if spec.Name != "" {
+					return nil, errf("missing arg %s", spec.Name)
+				}
+				return nil, errf("expect at least %d args, got %d", i+1, len(positional))
+			}
+			if variadic {
+				continue
+			}
+			if spec.Default == "" {
+				args = append(args, nil)
+				continue
+			}
+			values = []interface{}{rawArg{s: spec.Default}}
+		}
+		for _, v := range values {
+			c, err := convertArg(typ, v)
+			if err != nil {
+				name := spec.Name
+				if name == "" {
+					name = strconv.Itoa(i)
+				}
+				return nil, errf("arg %s: %v", name, err)
+			}
+			args = append(args, c)
+		}
+	}
+	if n := len(h.args); len(positional) > n && (n == 0 || h.args[n-1].Type&ArgVariadic == 0) {
+		return nil, errf("expect %d args, got %d", n, len(positional))
+	}
+	return args, nil
+}
+
+func convertArg(typ Arg, v interface{}) (interface{}, error) {
+	raw, isRaw := v.(rawArg)
+	if typ == ArgTypeList {
+		switch {
+		case isRaw && !raw.quoted && strings.HasPrefix(raw.s, "[") && strings.HasSuffix(raw.s, "]"):
+			l := make([]string, 0)
+			if inner := strings.TrimSpace(raw.s[1 : len(raw.s)-1]); inner != "" {
+				for _, e := range SplitArgs(inner) {
+					l = append(l, parseRawArg(e).s)
+				}
+			}
+			return l, nil
+		case isRaw:
+			return []string{raw.s}, nil
+		}
+		if l, ok := v.([]interface{}); ok {
+			s := make([]string, 0, len(l))
+			for _, e := range l {
+				s = append(s, fmt.Sprint(e))
+			}
+			return s, nil
+		}
+		return []string{fmt.Sprint(v)}, nil
+	}
+
+	if isRaw {
+		v = raw.s
+	}
+	if _, ok := v.([]interface{}); ok {
+		return nil, fmt.Errorf("list is not allowed")
+	}
+	s, isStr := v.(string)
+	switch typ {
+	case ArgTypeStr:
+		if isStr {
+			return s, nil
+		}
+		return fmt.Sprint(v), nil
+	case ArgTypeInt:
+		switch n := v.(type) {
+		case int:
+			return int64(n), nil
+		case int64:
+			return n, nil
+		case string:
+			return strconv.ParseInt(n, 10, 64)
+		}
+	case ArgTypeFloat:
+		switch n := v.(type) {
+		case int:
+			return float64(n), nil
+		case int64:
+			return float64(n), nil
+		case float64:
+			return n, nil
+		case string:
+			return strconv.ParseFloat(n, 64)
+		}
+	case ArgTypeBool:
+		switch b := v.(type) {
+		case bool:
+			return b, nil
+		case string:
+			return strconv.ParseBool(b)
+		}
+	case ArgTypeDuration:
+		if isStr {
+			return time.ParseDuration(s)
+		}
+	case ArgTypeRegexp:
+		if isStr {
+			return regexp.Compile(s)
+		}
+	default:
+		return nil, fmt.Errorf("unknown arg type %d", typ)
+	}
+	return nil, fmt.Errorf("%v is not valid %s", v, typ)
+}
+
+func (a Arg) String() string {
+	switch a &^ argFlags {
+	case ArgTypeInt:
+		return "int"
+	case ArgTypeStr:
+		return "string"
+	case ArgTypeFloat:
+		return "float"
+	case ArgTypeBool:
+		return "bool"
+	case ArgTypeDuration:
+		return "duration"
+	case ArgTypeRegexp:
+		return "regexp"
+	case ArgTypeList:
+		return "list"
+	}
+	return strconv.Itoa(int(a))
+}
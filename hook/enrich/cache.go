@@ -0,0 +1,62 @@
+package enrich
+
+import (
+	"container/list"
+	"time"
+)
+
+// lruCache is a lru cache with ttl, not goroutine safe
+type lruCache struct {
+	ttl   time.Duration
+	size  int
+	ll    *list.List
+	items map[string]*list.Element
+}
+
+type cacheEntry struct {
+	key    string
+	value  map[string]interface{}
+	expire time.Time
+}
+
+// size <= 0 means no limit, ttl <= 0 means never expire
+func newLruCache(ttl time.Duration, size int) *lruCache {
+	return &lruCache{
+		ttl:   ttl,
+		size:  size,
+		ll:    list.New(),
+		items: make(map[string]*list.Element),
+	}
+}
+
+// get the cached value, value may be nil which means the key not found in source
+func (c *lruCache) get(key string) (map[string]interface{}, bool) {
+	e, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	entry := e.Value.(*cacheEntry)
+	if c.ttl > 0 && time.Now().After(entry.expire) {
+		c.ll.Remove(e)
+		delete(c.items, key)
+		return nil, false
+	}
+	c.ll.MoveToFront(e)
+	return entry.value, true
+}
+
+func (c *lruCache) set(key string, value map[string]interface{}) {
+	expire := time.Now().Add(c.ttl)
+	if e, ok := c.items[key]; ok {
+		entry := e.Value.(*cacheEntry)
+		entry.value, entry.expire = value, expire
+		c.ll.MoveToFront(e)
+		return
+	}
+	c.items[key] = c.ll.PushFront(&cacheEntry{key: key, value: value, expire: expire})
+	for c.size > 0 && c.ll.Len() > c.size {
+		oldest := c.ll.Back()
+		c.ll.Remove(oldest)
+		delete(c.items, oldest.Value.(*cacheEntry).key)
+	}
+}
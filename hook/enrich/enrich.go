@@ -0,0 +1,390 @@
+/*
+Package enrich lookup the columns from a sql source by the row values and merge into the row.
+
+The query select the dimension table, e.g. `SELECT id, name AS user_name FROM user`, the rows of a batch
+lookup once with `SELECT * FROM (query) enrich_t WHERE enrich_t.id IN (?, ?, ...)`. the result columns
+except the match columns merge into RawMap and Table.Column, the row of not found key get nil values.
+the result columns is resolved once by `SELECT * FROM (query) enrich_t WHERE 1 = 0` before the first merge.
+the result include not found is cached by key.
+*/
+package enrich
+
+import (
+	"database/sql"
+	"fmt"
+	_ "github.com/ClickHouse/clickhouse-go"
+	"github.com/enustah/db-canal/driver"
+	"github.com/enustah/db-canal/hook"
+	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/lib/pq"
+	"math"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+const subQueryAlias = "enrich_t"
+
+type Option struct {
+	// database/sql driver name, builtin mysql, postgres and clickhouse
+	Driver string
+	Dsn    string
+	// database and table of row to enrich, - match all
+	Database string
+	Table    string
+	Query    string
+	// row columns as lookup key
+	KeyColumns []string
+	// query result columns match the key columns
+	MatchColumns []string
+	// cache ttl, <= 0 never expire
+	TTL time.Duration
+	// max cached key, <= 0 no limit
+	CacheSize int
+	// max key in one query
+	BatchSize int
+}
+
+type Enricher struct {
+	option Option
+	db     *sql.DB
+	lock   sync.Mutex
+	cache  *lruCache
+	// column type of query result
+	columnType map[string]driver.ColumnType
+	// the query result columns except match columns, merge into every enriched row, nil before resolved
+	resultColumns []string
+}
+
+// a row to enrich and its lookup key
+type lookupRow struct {
+	data *driver.Data
+	key  string
+	args []interface{}
+}
+
+func New(option Option) (*Enricher, error) {
+	if option.Query == "" {
+		return nil, fmt.Errorf("enrich query is empty")
+	}
+	if len(option.KeyColumns) == 0 || len(option.KeyColumns) != len(option.MatchColumns) {
+		return nil, fmt.Errorf("enrich keyColumns and matchColumns should be same length and not empty")
+	}
+	if option.BatchSize <= 0 {
+		return nil, fmt.Errorf("enrich batchSize should be positive")
+	}
+	db, err := sql.Open(option.Driver, option.Dsn)
+	if err != nil {
+		return nil, err
+	}
+	return &Enricher{
+		option: option,
+		db:     db,
+		cache:  newLruCache(option.TTL, option.CacheSize),
+	}, nil
+}
+
+func (e *Enricher) String() string {
+	return e.option.Query
+}
+
+// Run lookup and merge the rows of ctx, the error of query return as hook error to retry
+func (e *Enricher) Run(ctx *hook.Ctx) error {
+	var (
+		rows []*lookupRow
+		// the rows without key get nil values
+		noKey []*driver.Data
+	)
+	ctx.ForEach(func(data *driver.Data) (drop bool, stop bool) {
+		if (e.option.Database != "-" && data.Database.Name != e.option.Database) ||
+			(e.option.Table != "-" && data.Table.Name != e.option.Table) {
+			return
+		}
+		if row, ok := e.lookupRow(data); ok {
+			rows = append(rows, row)
+		} else {
+			noKey = append(noKey, data)
+		}
+		return
+	})
+	if len(rows) == 0 && len(noKey) == 0 {
+		return nil
+	}
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if e.resultColumns == nil {
+		if err := e.resolveColumns(); err != nil {
+			return fmt.Errorf("enrich resolve result columns fail: %v", err)
+		}
+	}
+	result := make(map[string]map[string]interface{}, len(rows))
+	var missing []*lookupRow
+	for _, row := range rows {
+		if _, ok := result[row.key]; ok {
+			continue
+		}
+		if v, ok := e.cache.get(row.key); ok {
+			result[row.key] = v
+			continue
+		}
+		// mark the key is pending to dedup
+		result[row.key] = nil
+		missing = append(missing, row)
+	}
+	for start := 0; start < len(missing); start += e.option.BatchSize {
+		end := start + e.option.BatchSize
+		if end > len(missing) {
+			end = len(missing)
+		}
+		found, err := e.query(missing[start:end])
+		if err != nil {
+			return fmt.Errorf("enrich query fail: %v", err)
+		}
+		for _, row := range missing[start:end] {
+			// cache not found key as nil
+			result[row.key] = found[row.key]
+			e.cache.set(row.key, found[row.key])
+		}
+	}
+
+	// every enriched row has the same columns, nil if key not found
+	for _, row := range rows {
+		e.merge(row.data, result[row.key])
+	}
+	for _, data := range noKey {
+		e.merge(data, nil)
+	}
+	return nil
+}
+
+func (e *Enricher) merge(data *driver.Data, values map[string]interface{}) {
+	for _, col := range e.resultColumns {
+		data.RawMap[col] = values[col]
+		e.addColumn(data, col)
+	}
+}
+
+func (e *Enricher) lookupRow(data *driver.Data) (*lookupRow, bool) {
+	args := make([]interface{}, 0, len(e.option.KeyColumns))
+	for _, col := range e.option.KeyColumns {
+		v, ok := data.RawMap[col]
+		if !ok || v == nil {
+			return nil, false
+		}
+		args = append(args, v)
+	}
+	return &lookupRow{data: data, key: lookupKey(args), args: args}, true
+}
+
+// the key of row values and query result should be same, e.g. int64 and []byte of number
+func lookupKey(values []interface{}) string {
+	var b strings.Builder
+	for i, v := range values {
+		if i != 0 {
+			b.WriteByte(0)
+		}
+		if bs, ok := v.([]byte); ok {
+			b.Write(bs)
+		} else {
+			b.WriteString(fmt.Sprint(v))
+		}
+	}
+	return b.String()
+}
+
+// query the rows in batch, return the values by key
+func (e *Enricher) query(rows []*lookupRow) (map[string]map[string]interface{}, error) {
+	var (
+		args  = make([]interface{}, 0, len(rows)*len(e.option.MatchColumns))
+		conds = make([]string, 0, len(rows))
+		n     = 0
+	)
+	for _, row := range rows {
+		holders := make([]string, 0, len(row.args))
+		for _, v := range row.args {
+			n++
+			holders = append(holders, e.placeholder(n))
+			args = append(args, v)
+		}
+		if len(holders) == 1 {
+			conds = append(conds, holders[0])
+		} else {
+			conds = append(conds, "("+strings.Join(holders, ", ")+")")
+		}
+	}
+	matchColumns := make([]string, 0, len(e.option.MatchColumns))
+	for _, v := range e.option.MatchColumns {
+		matchColumns = append(matchColumns, subQueryAlias+"."+v)
+	}
+	match := matchColumns[0]
+	if len(matchColumns) > 1 {
+		match = "(" + strings.Join(matchColumns, ", ") + ")"
+	}
+	query := fmt.Sprintf("SELECT * FROM (%s) %s WHERE %s IN (%s)", e.option.Query, subQueryAlias, match, strings.Join(conds, ", "))
+
+	result, err := e.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer result.Close()
+	columns, err := result.ColumnTypes()
+	if err != nil {
+		return nil, err
+	}
+	matchIdx := make(map[string]int, len(e.option.MatchColumns))
+	for i, c := range columns {
+		matchIdx[c.Name()] = i
+	}
+	for _, v := range e.option.MatchColumns {
+		if _, ok := matchIdx[v]; !ok {
+			return nil, fmt.Errorf("match column %s not in query result", v)
+		}
+	}
+
+	found := make(map[string]map[string]interface{})
+	for result.Next() {
+		values := make([]interface{}, len(columns))
+		ptrs := make([]interface{}, len(columns))
+		for i := range values {
+			ptrs[i] = &values[i]
+		}
+		if err = result.Scan(ptrs...); err != nil {
+			return nil, err
+		}
+		keyValues := make([]interface{}, 0, len(e.option.MatchColumns))
+		for _, v := range e.option.MatchColumns {
+			keyValues = append(keyValues, values[matchIdx[v]])
+		}
+		row := make(map[string]interface{}, len(columns))
+		for i, c := range columns {
+			if !e.isMatchColumn(c.Name()) {
+				if row[c.Name()], err = normalize(values[i]); err != nil {
+					return nil, fmt.Errorf("column %s: %v", c.Name(), err)
+				}
+			}
+		}
+		found[lookupKey(keyValues)] = row
+	}
+	return found, result.Err()
+}
+
+// resolve the column and type of query result without row, so the rows before any lookup get the columns
+func (e *Enricher) resolveColumns() error {
+	result, err := e.db.Query(fmt.Sprintf("SELECT * FROM (%s) %s WHERE 1 = 0", e.option.Query, subQueryAlias))
+	if err != nil {
+		return err
+	}
+	defer result.Close()
+	columns, err := result.ColumnTypes()
+	if err != nil {
+		return err
+	}
+	resultColumns := make([]string, 0, len(columns))
+	columnTypes := make(map[string]driver.ColumnType, len(columns))
+	for _, c := range columns {
+		columnTypes[c.Name()] = columnType(c.ScanType())
+		if !e.isMatchColumn(c.Name()) {
+			resultColumns = append(resultColumns, c.Name())
+		}
+	}
+	for _, v := range e.option.MatchColumns {
+		if _, ok := columnTypes[v]; !ok {
+			return fmt.Errorf("match column %s not in query result", v)
+		}
+	}
+	e.columnType, e.resultColumns = columnTypes, resultColumns
+	return nil
+}
+
+func (e *Enricher) placeholder(n int) string {
+	switch e.option.Driver {
+	case "postgres", "pgx":
+		return fmt.Sprintf("$%d", n)
+	}
+	return "?"
+}
+
+func (e *Enricher) isMatchColumn(col string) bool {
+	for _, v := range e.option.MatchColumns {
+		if v == col {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *Enricher) addColumn(data *driver.Data, col string) {
+	for _, v := range data.Table.Column {
+		if v.Name == col {
+			return
+		}
+	}
+	typ, ok := e.columnType[col]
+	if !ok {
+		typ = driver.ColumnTypeUnknown
+	}
+	data.Table.Column = append(data.Table.Column, &driver.Column{Name: col, Type: typ})
+}
+
+// convert the value of sql to the type of driver.ColumnType
+func normalize(v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case []byte:
+		return string(v), nil
+	case float32:
+		return float64(v), nil
+	}
+	val := reflect.ValueOf(v)
+	switch val.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32:
+		return val.Int(), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if val.Uint() > math.MaxInt64 {
+			return nil, fmt.Errorf("%d overflow int64", val.Uint())
+		}
+		return int64(val.Uint()), nil
+	}
+	return v, nil
+}
+
+var (
+	timeType       = reflect.TypeOf(time.Time{})
+	nullTimeType   = reflect.TypeOf(sql.NullTime{})
+	nullIntType    = reflect.TypeOf(sql.NullInt64{})
+	nullInt32Type  = reflect.TypeOf(sql.NullInt32{})
+	nullFloatType  = reflect.TypeOf(sql.NullFloat64{})
+	nullStringType = reflect.TypeOf(sql.NullString{})
+	rawBytesType   = reflect.TypeOf(sql.RawBytes{})
+)
+
+func columnType(t reflect.Type) driver.ColumnType {
+	if t == nil {
+		return driver.ColumnTypeUnknown
+	}
+	switch t {
+	case timeType, nullTimeType:
+		return driver.ColumnDatetime
+	case nullIntType, nullInt32Type:
+		return driver.ColumnTypeNumber
+	case nullFloatType:
+		return driver.ColumnTypeFloat
+	case nullStringType, rawBytesType:
+		return driver.ColumnTypeString
+	}
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return driver.ColumnTypeNumber
+	case reflect.Float32, reflect.Float64:
+		return driver.ColumnTypeFloat
+	case reflect.String:
+		return driver.ColumnTypeString
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return driver.ColumnTypeString
+		}
+	}
+	return driver.ColumnTypeUnknown
+}
@@ -0,0 +1,232 @@
+package expr
+
+import (
+	"github.com/enustah/db-canal/driver"
+	"github.com/shopspring/decimal"
+	"reflect"
+	"regexp"
+	"time"
+)
+
+// Expr is a compiled expression
+type Expr struct {
+	src  string
+	root node
+}
+
+func (e *Expr) String() string {
+	return e.src
+}
+
+// Match return whether the data match the expression. non bool result is true when it is not null, zero or empty string.
+func (e *Expr) Match(data *driver.Data) bool {
+	return truth(e.root.eval(data))
+}
+
+type node interface {
+	eval(data *driver.Data) interface{}
+}
+
+type fieldScope int
+
+const (
+	scopeNew fieldScope = iota
+	scopeOld
+	scopeMeta
+	scopeDatabase
+	scopeTable
+	scopeEvent
+)
+
+type (
+	literalNode struct {
+		v interface{}
+	}
+	fieldNode struct {
+		scope fieldScope
+		name  string
+	}
+	orNode struct {
+		left, right node
+	}
+	andNode struct {
+		left, right node
+	}
+	notNode struct {
+		n node
+	}
+	compareNode struct {
+		left, right node
+		op          string
+	}
+	matchNode struct {
+		left node
+		re   *regexp.Regexp
+		not  bool
+	}
+	inNode struct {
+		left node
+		list []node
+		not  bool
+	}
+)
+
+func (n *literalNode) eval(*driver.Data) interface{} {
+	return n.v
+}
+
+func (n *fieldNode) eval(data *driver.Data) interface{} {
+	switch n.scope {
+	case scopeNew:
+		return data.RawMap[n.name]
+	case scopeOld:
+		return data.OldDataMap[n.name]
+	case scopeMeta:
+		return data.Metadata[n.name]
+	case scopeDatabase:
+		if data.Database == nil {
+			return nil
+		}
+		return data.Database.Name
+	case scopeTable:
+		if data.Table == nil {
+			return nil
+		}
+		return data.Table.Name
+	case scopeEvent:
+		return string(data.Event)
+	}
+	return nil
+}
+
+func (n *orNode) eval(data *driver.Data) interface{} {
+	return truth(n.left.eval(data)) || truth(n.right.eval(data))
+}
+
+func (n *andNode) eval(data *driver.Data) interface{} {
+	return truth(n.left.eval(data)) && truth(n.right.eval(data))
+}
+
+func (n *notNode) eval(data *driver.Data) interface{} {
+	return !truth(n.n.eval(data))
+}
+
+func (n *compareNode) eval(data *driver.Data) interface{} {
+	return compare(n.left.eval(data), n.right.eval(data), n.op)
+}
+
+func (n *matchNode) eval(data *driver.Data) interface{} {
+	s, ok := normalize(n.left.eval(data)).(string)
+	if !ok {
+		return false
+	}
+	return n.re.MatchString(s) != n.not
+}
+
+func (n *inNode) eval(data *driver.Data) interface{} {
+	v := n.left.eval(data)
+	for _, item := range n.list {
+		if compare(v, item.eval(data), "==") {
+			return !n.not
+		}
+	}
+	return n.not
+}
+
+func truth(v interface{}) bool {
+	switch v := normalize(v).(type) {
+	case nil:
+		return false
+	case bool:
+		return v
+	case float64:
+		return v != 0
+	case string:
+		return v != ""
+	}
+	return true
+}
+
+/*
+normalize convert value to one of nil, bool, float64, string to compare.
+number convert to float64, time convert to unix second, []byte convert to string.
+*/
+func normalize(v interface{}) interface{} {
+	switch v := v.(type) {
+	case nil, bool, float64, string:
+		return v
+	case []byte:
+		return string(v)
+	case time.Time:
+		return float64(v.Unix())
+	case decimal.Decimal:
+		f, _ := v.Float64()
+		return f
+	case driver.Event:
+		return string(v)
+	}
+	val := reflect.ValueOf(v)
+	switch val.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(val.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(val.Uint())
+	case reflect.Float32, reflect.Float64:
+		return val.Float()
+	case reflect.String:
+		return val.String()
+	case reflect.Bool:
+		return val.Bool()
+	}
+	return v
+}
+
+func compare(l, r interface{}, op string) bool {
+	l, r = normalize(l), normalize(r)
+	switch lv := l.(type) {
+	case float64:
+		if rv, ok := r.(float64); ok {
+			return compareOrdered(lv, rv, op)
+		}
+	case string:
+		if rv, ok := r.(string); ok {
+			return compareOrdered(lv, rv, op)
+		}
+	case bool:
+		if rv, ok := r.(bool); ok {
+			return compareEqual(lv == rv, op)
+		}
+	case nil:
+		return compareEqual(r == nil, op)
+	}
+	// different type
+	return op == "!="
+}
+
+func compareOrdered[T float64 | string](l, r T, op string) bool {
+	switch op {
+	case "==":
+		return l == r
+	case "!=":
+		return l != r
+	case ">":
+		return l > r
+	case ">=":
+		return l >= r
+	case "<":
+		return l < r
+	case "<=":
+		return l <= r
+	}
+	return false
+}
+
+func compareEqual(equal bool, op string) bool {
+	switch op {
+	case "==":
+		return equal
+	case "!=":
+		return !equal
+	}
+	return false
+}
@@ -0,0 +1,327 @@
+/*
+Package expr implement a small boolean expression language to match driver.Data.
+
+	db == "shop" && table =~ "order_.*" && status in (1,2) && amount > 100
+
+identifier:
+  - db, table, event: database name, table name and event (insert update delete) of data
+  - new.column or column: value of RawMap
+  - old.column: value of OldDataMap, null when data has no old value
+  - meta.key: value of Metadata
+
+literal: "str" 'str' 123 1.5 true false null
+
+operator, from low to high precedence: || && ! (== != > >= < <= =~ !~ in, not in)
+
+Numbers (any int, uint, float and decimal) compare as float64, time compare as unix second,
+[]byte compare as string. Compare between different type is false except !=.
+*/
+package expr
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenIdent
+	tokenStr
+	tokenNum
+	tokenOp
+	tokenLParen
+	tokenRParen
+	tokenComma
+	tokenDot
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+// operators, longer first
+var operators = []string{"&&", "||", "==", "!=", ">=", "<=", "=~", "!~", ">", "<", "!"}
+
+func lex(s string) ([]token, error) {
+	var tokens []token
+	i := 0
+	for i < len(s) {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '(':
+			tokens = append(tokens, token{kind: tokenLParen, text: "(", pos: i})
+			i++
+		case c == ')':
+			tokens = append(tokens, token{kind: tokenRParen, text: ")", pos: i})
+			i++
+		case c == ',':
+			tokens = append(tokens, token{kind: tokenComma, text: ",", pos: i})
+			i++
+		case c == '.':
+			tokens = append(tokens, token{kind: tokenDot, text: ".", pos: i})
+			i++
+		case c == '"' || c == '\'':
+			var b strings.Builder
+			j := i + 1
+			for ; j < len(s) && s[j] != c; j++ {
+				if s[j] == '\\' && j+1 < len(s) {
+					j++
+				}
+				b.WriteByte(s[j])
+			}
+			if j >= len(s) {
+				return nil, fmt.Errorf("unclosed string at %d", i)
+			}
+			tokens = append(tokens, token{kind: tokenStr, text: b.String(), pos: i})
+			i = j + 1
+		case c >= '0' && c <= '9' || (c == '-' && i+1 < len(s) && s[i+1] >= '0' && s[i+1] <= '9'):
+			j := i + 1
+			for j < len(s) && (s[j] >= '0' && s[j] <= '9' || s[j] == '.') {
+				j++
+			}
+			tokens = append(tokens, token{kind: tokenNum, text: s[i:j], pos: i})
+			i = j
+		case c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z':
+			j := i + 1
+			for j < len(s) && (s[j] == '_' || s[j] >= 'a' && s[j] <= 'z' || s[j] >= 'A' && s[j] <= 'Z' || s[j] >= '0' && s[j] <= '9') {
+				j++
+			}
+			tokens = append(tokens, token{kind: tokenIdent, text: s[i:j], pos: i})
+			i = j
+		default:
+			op := ""
+			for _, v := range operators {
+				if strings.HasPrefix(s[i:], v) {
+					op = v
+					break
+				}
+			}
+			if op == "" {
+				return nil, fmt.Errorf("unexpected `%c` at %d", c, i)
+			}
+			tokens = append(tokens, token{kind: tokenOp, text: op, pos: i})
+			i += len(op)
+		}
+	}
+	return append(tokens, token{kind: tokenEOF, pos: len(s)}), nil
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokenEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) isOp(op string) bool {
+	t := p.peek()
+	return t.kind == tokenOp && t.text == op
+}
+
+func (p *parser) isKeyword(k string) bool {
+	t := p.peek()
+	return t.kind == tokenIdent && t.text == k
+}
+
+func (p *parser) expect(kind tokenKind, text string) error {
+	t := p.next()
+	if t.kind != kind {
+		return fmt.Errorf("expect `%s` at %d, got `%s`", text, t.pos, t.text)
+	}
+	return nil
+}
+
+// Compile parse the expression, the result can be reused concurrently.
+func Compile(s string) (*Expr, error) {
+	tokens, err := lex(s)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	n, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokenEOF {
+		return nil, fmt.Errorf("unexpected `%s` at %d", t.text, t.pos)
+	}
+	return &Expr{src: s, root: n}, nil
+}
+
+func (p *parser) parseOr() (node, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.isOp("||") {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &orNode{left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseAnd() (node, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.isOp("&&") {
+		p.next()
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = &andNode{left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseUnary() (node, error) {
+	if p.isOp("!") {
+		p.next()
+		n, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &notNode{n: n}, nil
+	}
+	return p.parseCompare()
+}
+
+func (p *parser) parseCompare() (node, error) {
+	left, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	t := p.peek()
+	switch {
+	case t.kind == tokenOp && (t.text == "=~" || t.text == "!~"):
+		p.next()
+		r := p.next()
+		if r.kind != tokenStr {
+			return nil, fmt.Errorf("right side of %s at %d must be string", t.text, t.pos)
+		}
+		re, err := regexp.Compile(r.text)
+		if err != nil {
+			return nil, err
+		}
+		return &matchNode{left: left, re: re, not: t.text == "!~"}, nil
+	case t.kind == tokenOp && t.text != "&&" && t.text != "||" && t.text != "!":
+		p.next()
+		right, err := p.parsePrimary()
+		if err != nil {
+			return nil, err
+		}
+		return &compareNode{left: left, right: right, op: t.text}, nil
+	case p.isKeyword("in"):
+		p.next()
+		return p.parseIn(left, false)
+	case p.isKeyword("not"):
+		p.next()
+		if !p.isKeyword("in") {
+			return nil, fmt.Errorf("expect `in` after `not` at %d", t.pos)
+		}
+		p.next()
+		return p.parseIn(left, true)
+	}
+	return left, nil
+}
+
+func (p *parser) parseIn(left node, not bool) (node, error) {
+	if err := p.expect(tokenLParen, "("); err != nil {
+		return nil, err
+	}
+	n := &inNode{left: left, not: not}
+	for {
+		v, err := p.parsePrimary()
+		if err != nil {
+			return nil, err
+		}
+		n.list = append(n.list, v)
+		if p.peek().kind != tokenComma {
+			break
+		}
+		p.next()
+	}
+	return n, p.expect(tokenRParen, ")")
+}
+
+func (p *parser) parsePrimary() (node, error) {
+	t := p.next()
+	switch t.kind {
+	case tokenLParen:
+		n, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		return n, p.expect(tokenRParen, ")")
+	case tokenStr:
+		return &literalNode{v: t.text}, nil
+	case tokenNum:
+		if strings.Contains(t.text, ".") {
+			f, err := strconv.ParseFloat(t.text, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid number %s at %d", t.text, t.pos)
+			}
+			return &literalNode{v: f}, nil
+		}
+		i, err := strconv.ParseInt(t.text, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %s at %d", t.text, t.pos)
+		}
+		return &literalNode{v: i}, nil
+	case tokenIdent:
+		switch t.text {
+		case "true":
+			return &literalNode{v: true}, nil
+		case "false":
+			return &literalNode{v: false}, nil
+		case "null":
+			return &literalNode{v: nil}, nil
+		case "db":
+			return &fieldNode{scope: scopeDatabase}, nil
+		case "table":
+			return &fieldNode{scope: scopeTable}, nil
+		case "event":
+			return &fieldNode{scope: scopeEvent}, nil
+		case "new", "old", "meta":
+			if p.peek().kind != tokenDot {
+				break
+			}
+			p.next()
+			name := p.next()
+			if name.kind != tokenIdent {
+				return nil, fmt.Errorf("expect name after %s. at %d", t.text, name.pos)
+			}
+			scope := map[string]fieldScope{"new": scopeNew, "old": scopeOld, "meta": scopeMeta}[t.text]
+			return &fieldNode{scope: scope, name: name.text}, nil
+		}
+		return &fieldNode{scope: scopeNew, name: t.text}, nil
+	}
+	if t.kind == tokenEOF {
+		return nil, fmt.Errorf("unexpected end of expression")
+	}
+	return nil, fmt.Errorf("unexpected `%s` at %d", t.text, t.pos)
+}
@@ -1,27 +1,24 @@
 package hook
 
 import (
-	"fmt"
 	"github.com/bits-and-blooms/bitset"
 	"github.com/enustah/db-canal/driver"
 	"github.com/enustah/db-canal/util"
 	"github.com/kr/pretty"
-	"strconv"
-	"strings"
-)
-
-type Arg int
-
-// Arg use to validate hook arg type, will cast to one of int64 string float64.
-const (
-	ArgTypeInt Arg = iota
-	ArgTypeStr
-	ArgTypeFloat
 )
 
 type ctxDataBatchWarp struct {
 	dataBatch []*driver.Data
 	dropMap   bitset.BitSet
+	// insert and replace in ForEach apply after ForEach return
+	iterating bool
+	pending   map[*driver.Data]*rowOp
+}
+
+// rowOp is the rows insert after or replace a row
+type rowOp struct {
+	replace bool
+	rows    []*driver.Data
 }
 
 type Ctx struct {
@@ -33,13 +30,21 @@ type Ctx struct {
 }
 
 func (c *Ctx) ForEach(f func(data *driver.Data) (drop bool, stop bool)) {
-	for i, v := range c.dataBatchWarp.dataBatch {
-		if !c.dataBatchWarp.dropMap.Test(uint(i)) {
+	w := c.dataBatchWarp
+	if !w.iterating {
+		w.iterating = true
+		defer func() {
+			w.iterating = false
+			c.applyPending()
+		}()
+	}
+	for i, v := range w.dataBatch {
+		if !w.dropMap.Test(uint(i)) {
 			drop, stop := f(v)
 			if drop {
 				util.GetLog().WithField("data", pretty.Sprint(v)).
 					Debugf("data drop. ")
-				c.dataBatchWarp.dropMap.SetTo(uint(i), true)
+				w.dropMap.SetTo(uint(i), true)
 			}
 			if stop {
 				util.GetLog().WithField("on data", pretty.Sprintf("%v", v)).
@@ -50,6 +55,114 @@ func (c *Ctx) ForEach(f func(data *driver.Data) (drop bool, stop bool)) {
 	}
 }
 
+// Append add new data to the end of data batch, the following ForEach and hooks will see it
+func (c *Ctx) Append(data ...*driver.Data) {
+	c.dataBatchWarp.dataBatch = append(c.dataBatchWarp.dataBatch, data...)
+}
+
+/*
+InsertAfter add new data after the data in batch, e.g. fan out one row into several.
+Insert in ForEach take effect after ForEach return, so the current ForEach not iterate the new data.
+The data can also be the new data of InsertAfter or Replace in the same ForEach.
+*/
+func (c *Ctx) InsertAfter(data *driver.Data, newData ...*driver.Data) {
+	c.addOp(data, false, newData)
+}
+
+/*
+Replace the data in batch with zero or more new data, e.g. explode a json array column to rows.
+The replaced data is removed even it is dropped. Replace in ForEach take effect after ForEach return,
+drop the data which is replaced in the same ForEach is ignored.
+*/
+func (c *Ctx) Replace(data *driver.Data, newData ...*driver.Data) {
+	c.addOp(data, true, newData)
+}
+
+func (c *Ctx) addOp(data *driver.Data, replace bool, newData []*driver.Data) {
+	w := c.dataBatchWarp
+	if w.pending == nil {
+		w.pending = make(map[*driver.Data]*rowOp)
+	}
+	op, ok := w.pending[data]
+	if !ok {
+		op = &rowOp{}
+		w.pending[data] = op
+	}
+	op.replace = op.replace || replace
+	op.rows = append(op.rows, newData...)
+	if !w.iterating {
+		c.applyPending()
+	}
+}
+
+// rebuild the data batch and drop bitset with pending insert and replace
+func (c *Ctx) applyPending() {
+	w := c.dataBatchWarp
+	if len(w.pending) == 0 {
+		return
+	}
+	var (
+		batch   = make([]*driver.Data, 0, len(w.dataBatch))
+		dropMap bitset.BitSet
+		add     func(v *driver.Data, drop bool)
+	)
+	// the new data may has pending op too, each op apply once
+	add = func(v *driver.Data, drop bool) {
+		op, ok := w.pending[v]
+		delete(w.pending, v)
+		if !ok || !op.replace {
+			if drop {
+				dropMap.Set(uint(len(batch)))
+			}
+			batch = append(batch, v)
+		}
+		if ok {
+			for _, r := range op.rows {
+				add(r, false)
+			}
+		}
+	}
+	for i, v := range w.dataBatch {
+		add(v, w.dropMap.Test(uint(i)))
+	}
+	w.dataBatch, w.dropMap, w.pending = batch, dropMap, nil
+}
+
+/*
+Aggregate merge the not dropped data with the same key, the merged data keep the position of the first data
+of group and the rest is dropped. key return false to skip the data. merge return the merged data, nil means
+drop the whole group, then the next data of the key start a new group. Don't call Aggregate in ForEach.
+*/
+func (c *Ctx) Aggregate(key func(data *driver.Data) (string, bool),
+	merge func(acc, data *driver.Data) *driver.Data) {
+	type group struct {
+		idx int
+		acc *driver.Data
+	}
+	w := c.dataBatchWarp
+	groups := make(map[string]*group)
+	for i, v := range w.dataBatch {
+		if w.dropMap.Test(uint(i)) {
+			continue
+		}
+		k, ok := key(v)
+		if !ok {
+			continue
+		}
+		g, exist := groups[k]
+		if !exist || g.acc == nil {
+			groups[k] = &group{idx: i, acc: v}
+			continue
+		}
+		w.dropMap.Set(uint(i))
+		if g.acc = merge(g.acc, v); g.acc == nil {
+			w.dropMap.Set(uint(g.idx))
+		} else {
+			w.dataBatch[g.idx] = g.acc
+		}
+	}
+}
+
 func (c *Ctx) Next() {
 	log := util.GetLog().WithField("current index", c.idx)
 	if c.idx < len(c.hook.hooks) {
@@ -94,24 +207,41 @@ func (c *Ctx) runHook() {
 	}
 }
 
-// HookFunc args type is one of int64 float64 string
+/*
+HookFunc args type is the go type of Arg, e.g. int64 float64 string, or nil for omitted optional arg.
+the values of variadic arg flatten into the rest of args.
+*/
 type HookFunc func(ctx *Ctx, args []interface{}) error
 
 type Hook struct {
 	fn              HookFunc
-	expectArgsType  []Arg
+	args            []ArgSpec
 	name            string
 	argValidateFunc func(args []interface{}) error
 }
 
+/*
+NewHook create a hook with unnamed args. the optional f validate the args when hook append to hook chain,
+it can also replace the args in place with the parsed value, e.g. a compiled expression,
+then the HookFunc get the parsed value instead of string.
+*/
 func NewHook(fn HookFunc, name string, expectArgsType []Arg, f ...func(args []interface{}) error) *Hook {
+	args := make([]ArgSpec, 0, len(expectArgsType))
+	for _, v := range expectArgsType {
+		args = append(args, ArgSpec{Type: v})
+	}
+	return NewHookSpec(fn, name, args, f...)
+}
+
+// NewHookSpec create a hook with arg spec, the named arg can pass by key=value
+func NewHookSpec(fn HookFunc, name string, args []ArgSpec, f ...func(args []interface{}) error) *Hook {
 	var argValidateFunc func(args []interface{}) error
 	if len(f) != 0 {
 		argValidateFunc = f[0]
 	}
 	return &Hook{
 		fn:              fn,
-		expectArgsType:  expectArgsType,
+		args:            args,
 		name:            name,
 		argValidateFunc: argValidateFunc,
 	}
@@ -149,38 +279,29 @@ func (h *HookChain) PassThrough(data []*driver.Data) ([]*driver.Data, error) {
 	return passData, ctx.err
 }
 
+// Len return the number of hooks in chain
+func (h *HookChain) Len() int {
+	return len(h.hooks)
+}
+
+// AppendHook append hook with args of string form, the arg can be quoted string, list [a,b] or named key=value
 func (h *HookChain) AppendHook(hook *Hook, args []string) error {
-	if len(hook.expectArgsType) != len(args) {
-		return HookArgErr{
-			msg: fmt.Sprintf("hook %s expect %d args, got %d", hook.name, len(hook.expectArgsType), len(args)),
-		}
+	positional, named, err := hook.parseStrArgs(args)
+	if err != nil {
+		return err
 	}
-	var (
-		err   error
-		argsT = make([]interface{}, 0, len(args))
-	)
+	return h.appendHook(hook, positional, named)
+}
 
-	for i, v := range args {
-		v = strings.TrimSpace(v)
-		var c interface{}
-		switch hook.expectArgsType[i] {
-		case ArgTypeFloat:
-			c, err = strconv.ParseFloat(v, 64)
-			fallthrough
-		case ArgTypeInt:
-			c, err = strconv.ParseInt(v, 10, 64)
-			fallthrough
-		case ArgTypeStr:
-			if err != nil {
-				return err
-			}
-			c = v
-			argsT = append(argsT, c)
-		default:
-			return HookArgErr{
-				msg: fmt.Sprintf("unknown arg type on hook %s, args index %d", hook.name, i),
-			}
-		}
+// AppendHookArgs append hook with args of structured form, the value is string, number, bool or list
+func (h *HookChain) AppendHookArgs(hook *Hook, positional []interface{}, named map[string]interface{}) error {
+	return h.appendHook(hook, positional, named)
+}
+
+func (h *HookChain) appendHook(hook *Hook, positional []interface{}, named map[string]interface{}) error {
+	argsT, err := hook.convertArgs(positional, named)
+	if err != nil {
+		return err
 	}
 	if hook.argValidateFunc != nil {
 		if err := hook.argValidateFunc(argsT); err != nil {
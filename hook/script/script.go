@@ -0,0 +1,377 @@
+/*
+Package script run lua script as hook. The script should define one of the global function:
+
+	-- call per row, return false or set row.drop = true to drop the row
+	function process(row) end
+
+	-- call once per batch with the array of rows, set rows[i].drop = true to drop the row
+	function process_batch(rows) end
+
+row is a table {event=, db=, table=, new=, old=, meta=}. event, db, table and new write back to data
+after the call, old and meta are read only. the global function emit(row) add a new row after the current row,
+or to the end of batch in process_batch.
+
+Number convert to lua number (precision lost over 2^53), time convert to unix second, []byte convert to string.
+The value not changed by script keep the origin go value and type, changed integral number convert to int64.
+Table.Column follow the new row, the type of added or changed column derive from the go value.
+The changes apply to the data only after the whole run success.
+*/
+package script
+
+import (
+	"fmt"
+	"github.com/enustah/db-canal/driver"
+	"github.com/enustah/db-canal/hook"
+	"github.com/shopspring/decimal"
+	lua "github.com/yuin/gopher-lua"
+	"math"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	processFunc      = "process"
+	processBatchFunc = "process_batch"
+	emitFunc         = "emit"
+)
+
+// Script is a loaded lua script, lua state is not goroutine safe so the call is serialized
+type Script struct {
+	path  string
+	lock  sync.Mutex
+	state *lua.LState
+	fn    *lua.LFunction
+	batch bool
+
+	// base data of emit in process mode
+	current *driver.Data
+	// emitted rows of each source row, the key is nil in process_batch mode
+	emitted map[*driver.Data][]*driver.Data
+	// the new value of each row, apply when the run success
+	result  map[*driver.Data]*driver.Data
+	drop    map[*driver.Data]bool
+	emitErr error
+}
+
+// Load run the script file and find the process function
+func Load(path string) (*Script, error) {
+	s := &Script{path: path, state: lua.NewState()}
+	s.state.SetGlobal(emitFunc, s.state.NewFunction(s.emit))
+	if err := s.state.DoFile(path); err != nil {
+		s.state.Close()
+		return nil, err
+	}
+	if fn, ok := s.state.GetGlobal(processBatchFunc).(*lua.LFunction); ok {
+		s.fn, s.batch = fn, true
+	} else if fn, ok := s.state.GetGlobal(processFunc).(*lua.LFunction); ok {
+		s.fn = fn
+	} else {
+		s.state.Close()
+		return nil, fmt.Errorf("script %s not define function %s or %s", path, processFunc, processBatchFunc)
+	}
+	return s, nil
+}
+
+func (s *Script) String() string {
+	return s.path
+}
+
+/*
+Run the script on the data batch of ctx. error of script abort the run before drop and emit.
+the emitted rows insert after the source row in process mode, append to the batch in process_batch mode.
+*/
+func (s *Script) Run(ctx *hook.Ctx) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.emitted, s.drop = make(map[*driver.Data][]*driver.Data), make(map[*driver.Data]bool)
+	s.result = make(map[*driver.Data]*driver.Data)
+	s.emitErr, s.current = nil, nil
+	defer func() {
+		s.emitted, s.drop, s.result, s.current = nil, nil, nil, nil
+	}()
+
+	var err error
+	if s.batch {
+		err = s.runBatch(ctx)
+	} else {
+		err = s.runRow(ctx)
+	}
+	if err == nil {
+		err = s.emitErr
+	}
+	if err != nil {
+		return fmt.Errorf("script %s: %v", s.path, err)
+	}
+	ctx.ForEach(func(data *driver.Data) (drop bool, stop bool) {
+		if r, ok := s.result[data]; ok {
+			*data = *r
+		}
+		if rows := s.emitted[data]; len(rows) != 0 {
+			ctx.InsertAfter(data, rows...)
+		}
+		return s.drop[data], false
+	})
+	ctx.Append(s.emitted[nil]...)
+	return nil
+}
+
+func (s *Script) runRow(ctx *hook.Ctx) error {
+	var err error
+	ctx.ForEach(func(data *driver.Data) (drop bool, stop bool) {
+		s.current = data
+		row, orig := s.toRow(data)
+		if err = s.state.CallByParam(lua.P{Fn: s.fn, NRet: 1, Protect: true}, row); err != nil {
+			return false, true
+		}
+		ret := s.state.Get(-1)
+		s.state.Pop(1)
+		if s.result[data], err = s.buildRow(data, row, orig); err != nil {
+			return false, true
+		}
+		s.drop[data] = ret == lua.LFalse || lua.LVAsBool(row.RawGetString("drop"))
+		return
+	})
+	return err
+}
+
+func (s *Script) runBatch(ctx *hook.Ctx) error {
+	var (
+		data  []*driver.Data
+		rows  []*lua.LTable
+		origs []map[string]lua.LValue
+	)
+	rowsTable := s.state.NewTable()
+	ctx.ForEach(func(d *driver.Data) (drop bool, stop bool) {
+		row, orig := s.toRow(d)
+		data, rows, origs = append(data, d), append(rows, row), append(origs, orig)
+		rowsTable.Append(row)
+		return
+	})
+	if err := s.state.CallByParam(lua.P{Fn: s.fn, NRet: 0, Protect: true}, rowsTable); err != nil {
+		return err
+	}
+	for i, d := range data {
+		var err error
+		if s.result[d], err = s.buildRow(d, rows[i], origs[i]); err != nil {
+			return err
+		}
+		s.drop[d] = lua.LVAsBool(rows[i].RawGetString("drop"))
+	}
+	return nil
+}
+
+// lua function emit(row)
+func (s *Script) emit(L *lua.LState) int {
+	row := L.CheckTable(1)
+	var data *driver.Data
+	if s.current != nil {
+		data = s.current.DeepCopy()
+	} else {
+		data = &driver.Data{
+			Event:    driver.EventInsert,
+			RawMap:   map[string]interface{}{},
+			Table:    &driver.Table{},
+			Database: &driver.Database{},
+		}
+	}
+	data, err := s.buildRow(data, row, nil)
+	if err != nil {
+		s.emitErr = err
+		return 0
+	}
+	if data.Database.Name == "" || data.Table.Name == "" {
+		s.emitErr = fmt.Errorf("emit row without db or table")
+		return 0
+	}
+	s.emitted[s.current] = append(s.emitted[s.current], data)
+	return 0
+}
+
+// convert data to lua table, orig is the lua value of RawMap to find the unchanged value
+func (s *Script) toRow(data *driver.Data) (row *lua.LTable, orig map[string]lua.LValue) {
+	row = s.state.NewTable()
+	row.RawSetString("event", lua.LString(data.Event))
+	row.RawSetString("db", lua.LString(data.Database.Name))
+	row.RawSetString("table", lua.LString(data.Table.Name))
+
+	orig = make(map[string]lua.LValue, len(data.RawMap))
+	newTable := s.state.NewTable()
+	for k, v := range data.RawMap {
+		lv := s.toLua(v)
+		orig[k] = lv
+		newTable.RawSetString(k, lv)
+	}
+	row.RawSetString("new", newTable)
+	if data.OldDataMap != nil {
+		row.RawSetString("old", s.toLua(data.OldDataMap))
+	}
+	row.RawSetString("meta", s.toLua(data.Metadata))
+	return row, orig
+}
+
+/*
+buildRow convert lua table to the new data and keep the origin data unchanged. the new data has its own
+Database and Table, since they may be shared by the rows of same event.
+*/
+func (s *Script) buildRow(data *driver.Data, row *lua.LTable, orig map[string]lua.LValue) (*driver.Data, error) {
+	result := *data
+	if v, ok := row.RawGetString("event").(lua.LString); ok {
+		switch e := driver.Event(v); e {
+		case driver.EventInsert, driver.EventUpdate, driver.EventDelete:
+			result.Event = e
+		default:
+			return nil, fmt.Errorf("unknown event %s", v)
+		}
+	}
+	result.Database = &driver.Database{Name: data.Database.Name}
+	if v, ok := row.RawGetString("db").(lua.LString); ok {
+		result.Database.Name = string(v)
+	}
+	result.Table = &driver.Table{Name: data.Table.Name}
+	if v, ok := row.RawGetString("table").(lua.LString); ok {
+		result.Table.Name = string(v)
+	}
+	newTable, ok := row.RawGetString("new").(*lua.LTable)
+	if !ok {
+		return nil, fmt.Errorf("row.new of table %s is not table", result.Table.Name)
+	}
+	var (
+		rawMap  = make(map[string]interface{})
+		changed = make(map[string]bool)
+	)
+	newTable.ForEach(func(k, v lua.LValue) {
+		key := k.String()
+		if o, exist := orig[key]; exist && o == v {
+			rawMap[key] = data.RawMap[key]
+			return
+		}
+		rawMap[key] = fromLua(v)
+		changed[key] = true
+	})
+	result.RawMap = rawMap
+	result.Table.Column = syncColumn(data.Table.Column, rawMap, changed)
+	return &result, nil
+}
+
+// the column of new row, removed column is dropped, the type of changed and added column derive from value
+func syncColumn(column []*driver.Column, rawMap map[string]interface{}, changed map[string]bool) []*driver.Column {
+	var (
+		result = make([]*driver.Column, 0, len(rawMap))
+		exist  = make(map[string]bool, len(column))
+		added  = make([]string, 0)
+	)
+	for _, c := range column {
+		v, ok := rawMap[c.Name]
+		if !ok {
+			continue
+		}
+		exist[c.Name] = true
+		if typ := valueType(v); changed[c.Name] && v != nil && typ != c.Type &&
+			!(c.Type == driver.ColumnTypeEnum && typ == driver.ColumnTypeString) {
+			c = &driver.Column{Name: c.Name, Type: typ}
+		}
+		result = append(result, c)
+	}
+	for k := range rawMap {
+		if !exist[k] {
+			added = append(added, k)
+		}
+	}
+	sort.Strings(added)
+	for _, k := range added {
+		result = append(result, &driver.Column{Name: k, Type: valueType(rawMap[k])})
+	}
+	return result
+}
+
+// the column type of value convert from lua
+func valueType(v interface{}) driver.ColumnType {
+	switch v.(type) {
+	case int64:
+		return driver.ColumnTypeNumber
+	case float64:
+		return driver.ColumnTypeFloat
+	case string:
+		return driver.ColumnTypeString
+	case []interface{}, map[string]interface{}:
+		return driver.ColumnTypeStruct
+	}
+	return driver.ColumnTypeUnknown
+}
+
+func (s *Script) toLua(v interface{}) lua.LValue {
+	switch v := v.(type) {
+	case nil:
+		return lua.LNil
+	case bool:
+		return lua.LBool(v)
+	case string:
+		return lua.LString(v)
+	case []byte:
+		return lua.LString(v)
+	case driver.Event:
+		return lua.LString(v)
+	case time.Time:
+		return lua.LNumber(v.Unix())
+	case decimal.Decimal:
+		f, _ := v.Float64()
+		return lua.LNumber(f)
+	}
+	val := reflect.ValueOf(v)
+	switch val.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return lua.LNumber(val.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return lua.LNumber(val.Uint())
+	case reflect.Float32, reflect.Float64:
+		return lua.LNumber(val.Float())
+	case reflect.String:
+		return lua.LString(val.String())
+	case reflect.Slice, reflect.Array:
+		t := s.state.NewTable()
+		for i := 0; i < val.Len(); i++ {
+			t.Append(s.toLua(val.Index(i).Interface()))
+		}
+		return t
+	case reflect.Map:
+		t := s.state.NewTable()
+		iter := val.MapRange()
+		for iter.Next() {
+			t.RawSetString(fmt.Sprint(iter.Key().Interface()), s.toLua(iter.Value().Interface()))
+		}
+		return t
+	}
+	return lua.LString(fmt.Sprint(v))
+}
+
+// convert lua value to go, table with array part convert to slice
+func fromLua(v lua.LValue) interface{} {
+	switch v := v.(type) {
+	case lua.LBool:
+		return bool(v)
+	case lua.LString:
+		return string(v)
+	case lua.LNumber:
+		f := float64(v)
+		if f == math.Trunc(f) && math.Abs(f) < 1<<63 {
+			return int64(f)
+		}
+		return f
+	case *lua.LTable:
+		if n := v.MaxN(); n > 0 {
+			s := make([]interface{}, 0, n)
+			for i := 1; i <= n; i++ {
+				s = append(s, fromLua(v.RawGetInt(i)))
+			}
+			return s
+		}
+		m := make(map[string]interface{})
+		v.ForEach(func(k, val lua.LValue) {
+			m[k.String()] = fromLua(val)
+		})
+		return m
+	}
+	return nil
+}
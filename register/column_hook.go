@@ -0,0 +1,210 @@
+package register
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/enustah/db-canal/driver"
+	"github.com/enustah/db-canal/hook"
+	"github.com/enustah/db-canal/util"
+	"strconv"
+	"strings"
+)
+
+const (
+	maskHash     = "hash"
+	maskRedact   = "redact"
+	maskTruncate = "truncate"
+
+	redactVal = "***"
+	// keep length of truncate mask without :n
+	defaultTruncateLen = 4
+)
+
+// args of columnInclude and columnExclude, columns is variadic
+var columnsArgSpec = []hook.ArgSpec{
+	{Name: "db", Type: hook.ArgTypeStr},
+	{Name: "table", Type: hook.ArgTypeStr},
+	{Name: "columns", Type: hook.ArgTypeStr | hook.ArgVariadic},
+}
+
+/*
+register column hook, dbName and tableName use - to match all:
+columnInclude(db,table,cols...), columnExclude(db,table,cols...), columnRename(db,table,from,to) and columnMask(db,table,col,mode).
+the hooks modify RawMap, OldDataMap and Table.Column together.
+*/
+func init() {
+	util.Must(
+		RegisterHookSpec(
+			func(ctx *hook.Ctx, args []interface{}) error {
+				cols := argsSet(args[2:])
+				forEachTableData(ctx, args, func(data *driver.Data) {
+					keep := func(col string) bool {
+						_, ok := cols[col]
+						return ok
+					}
+					filterColumn(data, keep)
+				})
+				return nil
+			},
+			"columnInclude",
+			columnsArgSpec,
+		),
+	)
+
+	util.Must(
+		RegisterHookSpec(
+			func(ctx *hook.Ctx, args []interface{}) error {
+				cols := argsSet(args[2:])
+				forEachTableData(ctx, args, func(data *driver.Data) {
+					keep := func(col string) bool {
+						_, ok := cols[col]
+						return !ok
+					}
+					filterColumn(data, keep)
+				})
+				return nil
+			},
+			"columnExclude",
+			columnsArgSpec,
+		),
+	)
+
+	util.Must(
+		RegisterHookSpec(
+			func(ctx *hook.Ctx, args []interface{}) error {
+				from, to := args[2].(string), args[3].(string)
+				forEachTableData(ctx, args, func(data *driver.Data) {
+					for _, m := range []map[string]interface{}{data.RawMap, data.OldDataMap} {
+						if v, ok := m[from]; ok {
+							delete(m, from)
+							m[to] = v
+						}
+					}
+					for _, c := range data.Table.Column {
+						if c.Name == from {
+							c.Name = to
+						}
+					}
+				})
+				return nil
+			},
+			"columnRename",
+			[]hook.ArgSpec{
+				{Name: "db", Type: hook.ArgTypeStr},
+				{Name: "table", Type: hook.ArgTypeStr},
+				{Name: "from", Type: hook.ArgTypeStr},
+				{Name: "to", Type: hook.ArgTypeStr},
+			},
+		),
+	)
+
+	util.Must(
+		RegisterHookSpec(
+			func(ctx *hook.Ctx, args []interface{}) error {
+				col := args[2].(string)
+				mask, _ := parseMask(args[3].(string))
+				forEachTableData(ctx, args, func(data *driver.Data) {
+					for _, m := range []map[string]interface{}{data.RawMap, data.OldDataMap} {
+						if v, ok := m[col]; ok && v != nil {
+							m[col] = mask(v)
+						}
+					}
+					for _, c := range data.Table.Column {
+						if c.Name == col {
+							c.Type = driver.ColumnTypeString
+						}
+					}
+				})
+				return nil
+			},
+			"columnMask",
+			// mode is hash, redact or truncate[:n]
+			[]hook.ArgSpec{
+				{Name: "db", Type: hook.ArgTypeStr},
+				{Name: "table", Type: hook.ArgTypeStr},
+				{Name: "column", Type: hook.ArgTypeStr},
+				{Name: "mode", Type: hook.ArgTypeStr},
+			},
+			func(args []interface{}) error {
+				_, err := parseMask(args[3].(string))
+				return err
+			},
+		),
+	)
+}
+
+// iterate the data match args[0] dbName and args[1] tableName
+func forEachTableData(ctx *hook.Ctx, args []interface{}, f func(data *driver.Data)) {
+	dbName, tableName := args[0].(string), args[1].(string)
+	ctx.ForEach(func(data *driver.Data) (drop bool, stop bool) {
+		if (dbName == "-" || data.Database.Name == dbName) && (tableName == "-" || data.Table.Name == tableName) {
+			f(data)
+		}
+		return
+	})
+}
+
+func argsSet(args []interface{}) map[string]struct{} {
+	set := make(map[string]struct{}, len(args))
+	for _, v := range args {
+		set[v.(string)] = struct{}{}
+	}
+	return set
+}
+
+func filterColumn(data *driver.Data, keep func(col string) bool) {
+	for _, m := range []map[string]interface{}{data.RawMap, data.OldDataMap} {
+		for k := range m {
+			if !keep(k) {
+				delete(m, k)
+			}
+		}
+	}
+	column := data.Table.Column[:0]
+	for _, c := range data.Table.Column {
+		if keep(c.Name) {
+			column = append(column, c)
+		}
+	}
+	data.Table.Column = column
+}
+
+// parse mask mode to the mask func, the masked value is string
+func parseMask(mode string) (func(v interface{}) interface{}, error) {
+	name, n, hasN := strings.Cut(mode, ":")
+	switch {
+	case name == maskHash && !hasN:
+		return func(v interface{}) interface{} {
+			sum := sha256.Sum256([]byte(maskStr(v)))
+			return hex.EncodeToString(sum[:])
+		}, nil
+	case name == maskRedact && !hasN:
+		return func(v interface{}) interface{} {
+			return redactVal
+		}, nil
+	case name == maskTruncate:
+		l := defaultTruncateLen
+		if hasN {
+			var err error
+			if l, err = strconv.Atoi(n); err != nil || l < 0 {
+				return nil, fmt.Errorf("columnMask truncate length %s is not positive integer", n)
+			}
+		}
+		return func(v interface{}) interface{} {
+			r := []rune(maskStr(v))
+			if len(r) > l {
+				r = r[:l]
+			}
+			return string(r)
+		}, nil
+	}
+	return nil, fmt.Errorf("columnMask get unknown mode %s", mode)
+}
+
+func maskStr(v interface{}) string {
+	if b, ok := v.([]byte); ok {
+		return string(b)
+	}
+	return fmt.Sprint(v)
+}
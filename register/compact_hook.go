@@ -0,0 +1,92 @@
+package register
+
+import (
+	"fmt"
+	"github.com/enustah/db-canal/driver"
+	"github.com/enustah/db-canal/hook"
+	"github.com/enustah/db-canal/util"
+	"strings"
+)
+
+/*
+register compact(keyColumns...), collapse the data batch to the final state per key of each table:
+insert+update -> insert, insert+delete -> nothing, update+update -> last update with the earliest OldDataMap,
+update+delete -> delete, delete+insert -> update. the merged data keep the position of the first data.
+the data without key column is not compacted, and the update change the key end the compaction of old and new key.
+*/
+func init() {
+	util.Must(
+		RegisterHookSpec(
+			func(ctx *hook.Ctx, args []interface{}) error {
+				keyColumns := make([]string, 0, len(args))
+				for _, v := range args {
+					keyColumns = append(keyColumns, v.(string))
+				}
+				// generation of key, increase when the key is changed by update
+				gen := make(map[string]int)
+				ctx.Aggregate(func(data *driver.Data) (string, bool) {
+					key, ok := compactKey(data, data.RawMap, keyColumns)
+					if !ok {
+						return "", false
+					}
+					if data.Event == driver.EventUpdate && data.OldDataMap != nil {
+						if oldKey, ok := compactKey(data, data.OldDataMap, keyColumns); ok && oldKey != key {
+							gen[oldKey]++
+							gen[key]++
+							return "", false
+						}
+					}
+					return fmt.Sprintf("%s\x00%d", key, gen[key]), true
+				}, mergeCompact)
+				return nil
+			},
+			"compact",
+			[]hook.ArgSpec{{Name: "keyColumns", Type: hook.ArgTypeStr | hook.ArgVariadic}},
+		),
+	)
+}
+
+func compactKey(data *driver.Data, row map[string]interface{}, keyColumns []string) (string, bool) {
+	var b strings.Builder
+	b.WriteString(data.Database.Name)
+	b.WriteByte(0)
+	b.WriteString(data.Table.Name)
+	for _, col := range keyColumns {
+		v, ok := row[col]
+		if !ok {
+			return "", false
+		}
+		b.WriteByte(0)
+		if bs, ok := v.([]byte); ok {
+			b.Write(bs)
+		} else {
+			b.WriteString(fmt.Sprint(v))
+		}
+	}
+	return b.String(), true
+}
+
+// merge the later data into acc, nil means the key has no change in batch
+func mergeCompact(acc, data *driver.Data) *driver.Data {
+	switch {
+	case acc.Event == driver.EventInsert && data.Event == driver.EventUpdate:
+		merged := data.DeepCopy()
+		merged.Event = driver.EventInsert
+		merged.OldDataMap = nil
+		return merged
+	case acc.Event == driver.EventInsert && data.Event == driver.EventDelete:
+		return nil
+	case acc.Event == driver.EventUpdate && data.Event == driver.EventUpdate:
+		merged := data.DeepCopy()
+		if acc.OldDataMap != nil {
+			merged.OldDataMap = util.DeepCopyMap(acc.OldDataMap)
+		}
+		return merged
+	case acc.Event == driver.EventDelete && data.Event == driver.EventInsert:
+		merged := data.DeepCopy()
+		merged.Event = driver.EventUpdate
+		merged.OldDataMap = util.DeepCopyMap(acc.RawMap)
+		return merged
+	}
+	return data
+}
@@ -0,0 +1,330 @@
+package register
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/enustah/db-canal/driver"
+	"github.com/enustah/db-canal/hook"
+	"github.com/enustah/db-canal/util"
+	"github.com/kr/pretty"
+	"github.com/shopspring/decimal"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	convertString   = "string"
+	convertBytes    = "bytes"
+	convertInt      = "int"
+	convertFloat    = "float"
+	convertJson     = "json"
+	convertDatetime = "datetime"
+
+	defaultTimeLayout = "2006-01-02 15:04:05"
+)
+
+// convert the value of column to the target type, nil value is not converted
+type converter struct {
+	typ     driver.ColumnType
+	convert func(column *driver.Column, v interface{}) (interface{}, error)
+}
+
+/*
+register convert(db,table,column,targetType[,format]), convert the value of RawMap and OldDataMap to targetType,
+and update Column.Type and Column.Metadata. targetType and format:
+string(time layout), bytes, int(unix time unit s ms us ns, enum to index), float, json(string to object) and datetime(timezone).
+the hook return error and change nothing when any value can not convert.
+*/
+func init() {
+	util.Must(
+		RegisterHookSpec(
+			func(ctx *hook.Ctx, args []interface{}) error {
+				col, c := args[2].(string), args[3].(*converter)
+				// convert all value before change anything, the data of same event share the table,
+				// so the column is changed after all value convert with the column type before changed
+				type converted struct {
+					m map[string]interface{}
+					v interface{}
+				}
+				var (
+					values []converted
+					datas  []*driver.Data
+					err    error
+				)
+				forEachTableData(ctx, args, func(data *driver.Data) {
+					if err != nil {
+						return
+					}
+					column := findColumn(data, col)
+					for _, m := range []map[string]interface{}{data.RawMap, data.OldDataMap} {
+						v, ok := m[col]
+						if !ok || v == nil {
+							continue
+						}
+						nv, cerr := c.convert(column, v)
+						if cerr != nil {
+							err = fmt.Errorf("convert column %s value %s fail: %v", col, pretty.Sprint(v), cerr)
+							return
+						}
+						values = append(values, converted{m, nv})
+					}
+					datas = append(datas, data)
+				})
+				if err != nil {
+					return err
+				}
+				for _, v := range values {
+					v.m[col] = v.v
+				}
+				for _, data := range datas {
+					column := findColumn(data, col)
+					if _, ok := data.RawMap[col]; ok && column == nil {
+						column = &driver.Column{Name: col, Type: driver.ColumnTypeUnknown}
+						data.Table.Column = append(data.Table.Column, column)
+					}
+					if column != nil {
+						setColumnType(column, c.typ)
+					}
+				}
+				return nil
+			},
+			"convert",
+			[]hook.ArgSpec{
+				{Name: "db", Type: hook.ArgTypeStr},
+				{Name: "table", Type: hook.ArgTypeStr},
+				{Name: "column", Type: hook.ArgTypeStr},
+				{Name: "targetType", Type: hook.ArgTypeStr},
+				{Name: "format", Type: hook.ArgTypeStr | hook.ArgOptional},
+			},
+			func(args []interface{}) error {
+				format, _ := args[4].(string)
+				c, err := newConverter(args[3].(string), format)
+				if err != nil {
+					return err
+				}
+				args[3] = c
+				return nil
+			},
+		),
+	)
+}
+
+func newConverter(target, format string) (*converter, error) {
+	switch target {
+	case convertString:
+		layout := defaultTimeLayout
+		if format != "" {
+			layout = format
+		}
+		return &converter{driver.ColumnTypeString, func(column *driver.Column, v interface{}) (interface{}, error) {
+			return convertToString(v, layout)
+		}}, nil
+	case convertBytes:
+		return &converter{driver.ColumnTypeBytes, func(column *driver.Column, v interface{}) (interface{}, error) {
+			if b, ok := v.([]byte); ok {
+				return b, nil
+			}
+			s, err := convertToString(v, defaultTimeLayout)
+			if err != nil {
+				return nil, err
+			}
+			return []byte(s.(string)), nil
+		}}, nil
+	case convertInt:
+		unit := time.Second
+		switch format {
+		case "", "s":
+		case "ms":
+			unit = time.Millisecond
+		case "us":
+			unit = time.Microsecond
+		case "ns":
+			unit = time.Nanosecond
+		default:
+			return nil, fmt.Errorf("convert int get unknown time unit %s", format)
+		}
+		return &converter{driver.ColumnTypeNumber, func(column *driver.Column, v interface{}) (interface{}, error) {
+			return convertToInt(column, v, unit)
+		}}, nil
+	case convertFloat:
+		return &converter{driver.ColumnTypeFloat, func(column *driver.Column, v interface{}) (interface{}, error) {
+			return convertToFloat(v)
+		}}, nil
+	case convertJson:
+		return &converter{driver.ColumnTypeStruct, func(column *driver.Column, v interface{}) (interface{}, error) {
+			var s string
+			switch v := v.(type) {
+			case string:
+				s = v
+			case []byte:
+				s = string(v)
+			default:
+				// already structured
+				return v, nil
+			}
+			var obj interface{}
+			if err := json.Unmarshal([]byte(s), &obj); err != nil {
+				return nil, err
+			}
+			return obj, nil
+		}}, nil
+	case convertDatetime:
+		var loc *time.Location
+		if format != "" {
+			var err error
+			if loc, err = time.LoadLocation(format); err != nil {
+				return nil, fmt.Errorf("convert datetime get unknown timezone %s: %v", format, err)
+			}
+		}
+		return &converter{driver.ColumnDatetime, func(column *driver.Column, v interface{}) (interface{}, error) {
+			return convertToDatetime(column, v, loc)
+		}}, nil
+	}
+	return nil, fmt.Errorf("convert get unknown target type %s", target)
+}
+
+func findColumn(data *driver.Data, col string) *driver.Column {
+	for _, c := range data.Table.Column {
+		if c.Name == col {
+			return c
+		}
+	}
+	return nil
+}
+
+// set the column type and remove the metadata of old type
+func setColumnType(column *driver.Column, typ driver.ColumnType) {
+	if typ != driver.ColumnTypeEnum {
+		delete(column.Metadata, driver.ColumnMetadataEnum)
+	}
+	if typ == driver.ColumnDatetime {
+		if _, ok := column.Metadata[driver.ColumnMetadataTimeFormat]; !ok {
+			if column.Metadata == nil {
+				column.Metadata = make(map[string]interface{})
+			}
+			column.Metadata[driver.ColumnMetadataTimeFormat] = defaultTimeLayout
+		}
+	} else {
+		delete(column.Metadata, driver.ColumnMetadataTimeFormat)
+	}
+	column.Type = typ
+}
+
+func convertToString(v interface{}, layout string) (interface{}, error) {
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case []byte:
+		return string(v), nil
+	case time.Time:
+		return v.Format(layout), nil
+	case map[string]interface{}, []interface{}:
+		b, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		return string(b), nil
+	}
+	return fmt.Sprint(v), nil
+}
+
+func convertToInt(column *driver.Column, v interface{}, unit time.Duration) (interface{}, error) {
+	switch v := v.(type) {
+	case time.Time:
+		return v.UnixNano() / int64(unit), nil
+	case bool:
+		if v {
+			return int64(1), nil
+		}
+		return int64(0), nil
+	case decimal.Decimal:
+		return v.IntPart(), nil
+	case string, []byte:
+		s := strings.TrimSpace(maskStr(v))
+		// enum to the index start from 1, same as mysql
+		if column != nil && column.Type == driver.ColumnTypeEnum {
+			if values, ok := column.Metadata[driver.ColumnMetadataEnum].([]string); ok {
+				for i, e := range values {
+					if e == s {
+						return int64(i + 1), nil
+					}
+				}
+				return nil, fmt.Errorf("%s not in enum values", s)
+			}
+		}
+		if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return i, nil
+		}
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return nil, err
+		}
+		return int64(f), nil
+	}
+	val := reflect.ValueOf(v)
+	switch val.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return val.Int(), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if val.Uint() > math.MaxInt64 {
+			return nil, fmt.Errorf("%d overflow int64", val.Uint())
+		}
+		return int64(val.Uint()), nil
+	case reflect.Float32, reflect.Float64:
+		return int64(val.Float()), nil
+	}
+	return nil, fmt.Errorf("can not convert %T to int", v)
+}
+
+func convertToFloat(v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case decimal.Decimal:
+		f, _ := v.Float64()
+		return f, nil
+	case time.Time:
+		return float64(v.UnixNano()) / float64(time.Second), nil
+	case string, []byte:
+		return strconv.ParseFloat(strings.TrimSpace(maskStr(v)), 64)
+	}
+	val := reflect.ValueOf(v)
+	switch val.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(val.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(val.Uint()), nil
+	case reflect.Float32, reflect.Float64:
+		return val.Float(), nil
+	}
+	return nil, fmt.Errorf("can not convert %T to float", v)
+}
+
+// time value move to loc, string is parsed in loc, number is unix seconds
+func convertToDatetime(column *driver.Column, v interface{}, loc *time.Location) (interface{}, error) {
+	parseLoc := loc
+	if parseLoc == nil {
+		parseLoc = time.Local
+	}
+	switch v := v.(type) {
+	case time.Time:
+		if loc != nil {
+			return v.In(loc), nil
+		}
+		return v, nil
+	case string, []byte:
+		layout := defaultTimeLayout
+		if column != nil && column.Type == driver.ColumnDatetime {
+			if l, ok := column.Metadata[driver.ColumnMetadataTimeFormat].(string); ok {
+				layout = l
+			}
+		}
+		return time.ParseInLocation(layout, strings.TrimSpace(maskStr(v)), parseLoc)
+	}
+	i, err := convertToInt(nil, v, time.Second)
+	if err != nil {
+		return nil, err
+	}
+	return time.Unix(i.(int64), 0).In(parseLoc), nil
+}
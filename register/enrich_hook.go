@@ -0,0 +1,56 @@
+package register
+
+import (
+	"fmt"
+	"github.com/enustah/db-canal/hook"
+	"github.com/enustah/db-canal/hook/enrich"
+	"github.com/enustah/db-canal/util"
+	"time"
+)
+
+/*
+register enrich(driver,dsn,db,table,query,keyColumns,matchColumns[,ttl,cacheSize,batchSize]), lookup the query
+result by the keyColumns of row matching the matchColumns of result, and merge the other result columns into the row.
+the lookup result is cached, the error of query make the hook chain retry.
+*/
+func init() {
+	util.Must(
+		RegisterHookSpec(
+			func(ctx *hook.Ctx, args []interface{}) error {
+				return args[0].(*enrich.Enricher).Run(ctx)
+			},
+			"enrich",
+			[]hook.ArgSpec{
+				{Name: "driver", Type: hook.ArgTypeStr},
+				{Name: "dsn", Type: hook.ArgTypeStr},
+				{Name: "db", Type: hook.ArgTypeStr},
+				{Name: "table", Type: hook.ArgTypeStr},
+				{Name: "query", Type: hook.ArgTypeStr},
+				{Name: "keyColumns", Type: hook.ArgTypeList},
+				{Name: "matchColumns", Type: hook.ArgTypeList},
+				{Name: "ttl", Type: hook.ArgTypeDuration | hook.ArgOptional, Default: "1m"},
+				{Name: "cacheSize", Type: hook.ArgTypeInt | hook.ArgOptional, Default: "10000"},
+				{Name: "batchSize", Type: hook.ArgTypeInt | hook.ArgOptional, Default: "500"},
+			},
+			func(args []interface{}) error {
+				e, err := enrich.New(enrich.Option{
+					Driver:       args[0].(string),
+					Dsn:          args[1].(string),
+					Database:     args[2].(string),
+					Table:        args[3].(string),
+					Query:        args[4].(string),
+					KeyColumns:   args[5].([]string),
+					MatchColumns: args[6].([]string),
+					TTL:          args[7].(time.Duration),
+					CacheSize:    int(args[8].(int64)),
+					BatchSize:    int(args[9].(int64)),
+				})
+				if err != nil {
+					return fmt.Errorf("enrich hook init fail: %v", err)
+				}
+				args[0] = e
+				return nil
+			},
+		),
+	)
+}
@@ -4,36 +4,32 @@ import (
 	"fmt"
 	"github.com/enustah/db-canal/driver"
 	"github.com/enustah/db-canal/hook"
+	"github.com/enustah/db-canal/hook/expr"
+	"github.com/enustah/db-canal/hook/script"
 	"github.com/enustah/db-canal/util"
 	"github.com/shopspring/decimal"
 	"reflect"
+	"regexp"
 	"strconv"
 	"time"
 )
 
-// register builtin hook. Current implement delay(timeStr) and fieldFilter(field,operator,val)
+// register builtin hook. Current implement delay(timeStr), dataFilter(db,table,field,operator,val), filter(expr), script(path)
+// and route(dbPattern,tablePattern,targetDb,targetTable). column, compact, enrich and convert hook are in their own file
 func init() {
 	util.Must(
-		RegisterHook(
+		RegisterHookSpec(
 			func(ctx *hook.Ctx, args []interface{}) error {
-				t, err := util.ParseTimeStr(args[0].(string))
-				if err != nil {
-					return err
-				}
-				<-time.After(t)
+				<-time.After(args[0].(time.Duration))
 				return nil
 			},
 			"delay",
-			[]hook.Arg{hook.ArgTypeStr},
-			func(args []interface{}) error { // arg validator func
-				_, err := time.ParseDuration(args[0].(string))
-				return err
-			},
+			[]hook.ArgSpec{{Name: "duration", Type: hook.ArgTypeDuration}},
 		),
 	)
 
 	util.Must(
-		RegisterHook(
+		RegisterHookSpec(
 			func(ctx *hook.Ctx, args []interface{}) error {
 				var (
 					dbName    = args[0].(string)
@@ -55,13 +51,111 @@ func init() {
 				return nil
 			},
 			"dataFilter",
-			// args: dbName tableName fieldName operator value
-			[]hook.Arg{hook.ArgTypeStr, hook.ArgTypeStr, hook.ArgTypeStr, hook.ArgTypeStr, hook.ArgTypeStr},
+			[]hook.ArgSpec{
+				{Name: "db", Type: hook.ArgTypeStr},
+				{Name: "table", Type: hook.ArgTypeStr},
+				{Name: "field", Type: hook.ArgTypeStr},
+				{Name: "operator", Type: hook.ArgTypeStr},
+				{Name: "value", Type: hook.ArgTypeStr},
+			},
 			func(args []interface{}) error {
 				return validateOperator(args[3].(string))
 			},
 		),
 	)
+
+	util.Must(
+		RegisterHookSpec(
+			func(ctx *hook.Ctx, args []interface{}) error {
+				e := args[0].(*expr.Expr)
+				// only keep the data match the expression
+				ctx.ForEach(func(data *driver.Data) (drop bool, stop bool) {
+					return !e.Match(data), false
+				})
+				return nil
+			},
+			"filter",
+			[]hook.ArgSpec{{Name: "expr", Type: hook.ArgTypeStr}},
+			func(args []interface{}) error {
+				// compile once, the hook func get the compiled expression
+				e, err := expr.Compile(args[0].(string))
+				if err != nil {
+					return fmt.Errorf("filter expression `%s` compile fail: %v", args[0], err)
+				}
+				args[0] = e
+				return nil
+			},
+		),
+	)
+
+	util.Must(
+		RegisterHookSpec(
+			func(ctx *hook.Ctx, args []interface{}) error {
+				return args[0].(*script.Script).Run(ctx)
+			},
+			"script",
+			// lua script path
+			[]hook.ArgSpec{{Name: "path", Type: hook.ArgTypeStr}},
+			func(args []interface{}) error {
+				s, err := script.Load(args[0].(string))
+				if err != nil {
+					return fmt.Errorf("script %s load fail: %v", args[0], err)
+				}
+				args[0] = s
+				return nil
+			},
+		),
+	)
+
+	util.Must(
+		RegisterHookSpec(
+			func(ctx *hook.Ctx, args []interface{}) error {
+				var (
+					dbRe        = args[0].(*regexp.Regexp)
+					tableRe     = args[1].(*regexp.Regexp)
+					targetDb    = args[2].(string)
+					targetTable = args[3].(string)
+				)
+				ctx.ForEach(func(data *driver.Data) (drop bool, stop bool) {
+					dbMatch := dbRe.FindStringSubmatchIndex(data.Database.Name)
+					tableMatch := tableRe.FindStringSubmatchIndex(data.Table.Name)
+					if dbMatch == nil || tableMatch == nil {
+						return
+					}
+					if targetDb != "-" {
+						data.Database.Name = string(dbRe.ExpandString(nil, targetDb, data.Database.Name, dbMatch))
+					}
+					if targetTable != "-" {
+						data.Table.Name = string(tableRe.ExpandString(nil, targetTable, data.Table.Name, tableMatch))
+					}
+					return
+				})
+				return nil
+			},
+			"route",
+			[]hook.ArgSpec{
+				{Name: "dbPattern", Type: hook.ArgTypeStr},
+				{Name: "tablePattern", Type: hook.ArgTypeStr},
+				{Name: "targetDb", Type: hook.ArgTypeStr},
+				{Name: "targetTable", Type: hook.ArgTypeStr},
+			},
+			func(args []interface{}) error {
+				// pattern match the whole name, - match all
+				for i := 0; i < 2; i++ {
+					pattern := args[i].(string)
+					if pattern == "-" {
+						pattern = ".*"
+					}
+					re, err := regexp.Compile("^(?:" + pattern + ")$")
+					if err != nil {
+						return fmt.Errorf("route pattern %s compile fail: %v", args[i], err)
+					}
+					args[i] = re
+				}
+				return nil
+			},
+		),
+	)
 }
 
 const (
@@ -82,7 +176,7 @@ func compareVal[T float64 | string](i, f T, operator string) bool {
 	case gt:
 		return i > f
 	case gte:
-		return i < f
+		return i >= f
 	case lt:
 		return i < f
 	case lte:
@@ -54,6 +54,12 @@ func RegisterHook(fn hook.HookFunc, name string, expectArgsType []hook.Arg, argV
 	return register(hookRegisterMap, name, hook.NewHook(fn, name, expectArgsType, argValidateFunc...))
 }
 
+// RegisterHookSpec register hook with named args, the arg can pass by name in hook chain config
+func RegisterHookSpec(fn hook.HookFunc, name string, args []hook.ArgSpec, argValidateFunc ...func(args []interface{}) error) error {
+	util.GetLog().WithField("name", name).Infof("register hook")
+	return register(hookRegisterMap, name, hook.NewHookSpec(fn, name, args, argValidateFunc...))
+}
+
 func RegisterGetDriver(name string, typ driver.Type) (interface{}, error) {
 	d, err := registerGet(driverRegisterMap, name)
 	if err != nil {
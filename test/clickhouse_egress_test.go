@@ -1,6 +1,7 @@
 package test
 
 import (
+	"fmt"
 	"github.com/enustah/db-canal/canal/multi_canal"
 	"github.com/enustah/db-canal/config"
 	"github.com/enustah/db-canal/driver"
@@ -74,3 +75,288 @@ func TestClickhouseEgress(t *testing.T) {
 
 	<-(chan interface{})(nil)
 }
+
+const clickhouseStrategyConf = `
+config:
+  - ingress:
+      driver: fake_ingress
+      dsn: ""
+
+    canalConfig:
+      name: test_ch_strategy
+      maxWaitTime: 3000
+      maxDataBatch: 10
+
+      retryOption:
+        maxInterval: 3000
+        multiplier: 1.5
+        initialInterval: 1000
+
+    egress:
+      - driver: clickhouse_egress
+        url: "tcp://172.17.0.2:9000?database=test&username=root&password=root"
+        hookChain:
+          - "chEventHk()"
+        options:
+          tables:
+            test_replacing:
+              strategy: replacing
+              versionColumn: _version
+              deleteColumn: _is_deleted
+            test_collapsing:
+              strategy: collapsing
+              signColumn: _sign
+            test_mutation:
+              strategy: mutation
+              keyColumn:
+                - id
+
+
+logLevel: "info"
+`
+
+/*
+CREATE TABLE test_replacing
+(
+    `id` UInt64,
+    `name` String,
+    `_version` UInt64,
+    `_is_deleted` UInt8
+)
+ENGINE = ReplacingMergeTree(_version, _is_deleted)
+ORDER BY id;
+
+CREATE TABLE test_collapsing
+(
+    `id` UInt64,
+    `name` String,
+    `_sign` Int8
+)
+ENGINE = CollapsingMergeTree(_sign)
+ORDER BY id;
+
+CREATE TABLE test_mutation
+(
+    `id` UInt64,
+    `name` String
+)
+ENGINE = MergeTree
+ORDER BY id;
+*/
+
+func TestClickhouseEgressStrategy(t *testing.T) {
+	tables := []string{"test_replacing", "test_collapsing", "test_mutation"}
+	util.Must(register.RegisterHook(func(ctx *hook.Ctx, args []interface{}) error {
+		ctx.ForEach(func(data *driver.Data) (drop bool, stop bool) {
+			// insert, update then delete the same id on every table
+			data.Table.Name = tables[i%3]
+			id := i / 9
+			switch (i / 3) % 3 {
+			case 0:
+				data.Event = driver.EventInsert
+			case 1:
+				data.Event = driver.EventUpdate
+				data.OldDataMap = map[string]interface{}{"id": id, "name": "tttaaa"}
+			case 2:
+				data.Event = driver.EventDelete
+			}
+			data.RawMap["id"] = id
+			data.RawMap["name"] = "tttaaa"
+			if data.Event == driver.EventUpdate {
+				data.RawMap["name"] = "updated"
+			}
+			i += 1
+
+			pretty.Println(data)
+			return false, false
+		})
+		return nil
+	}, "chEventHk", nil))
+
+	c, err := config.FromYaml(clickhouseStrategyConf)
+	util.Must(err)
+	cc, err := multi_canal.NewMultiCanal(c[0])
+	util.Must(err)
+	util.Must(cc.Run())
+
+	<-(chan interface{})(nil)
+}
+
+const clickhouseNativeConf = `
+config:
+  - ingress:
+      driver: fake_ingress
+      dsn: ""
+
+    canalConfig:
+      name: test_ch_native
+      maxWaitTime: 3000
+      maxDataBatch: 1000
+
+      retryOption:
+        maxInterval: 3000
+        multiplier: 1.5
+        initialInterval: 1000
+
+    egress:
+      - driver: clickhouse_egress
+        url: "tcp://172.17.0.2:9000?database=test&username=root&password=root"
+        hookChain:
+          - "chNativeHk()"
+        options:
+          nativeProtocol: true
+          asyncInsert: true
+          waitForAsyncInsert: true
+
+
+logLevel: "info"
+`
+
+func TestClickhouseEgressNative(t *testing.T) {
+	util.Must(register.RegisterHook(func(ctx *hook.Ctx, args []interface{}) error {
+		ctx.ForEach(func(data *driver.Data) (drop bool, stop bool) {
+			// int64 id write to UInt64 column
+			data.Table.Name = "test"
+			data.RawMap["id"] = i
+			i += 1
+			return false, false
+		})
+		return nil
+	}, "chNativeHk", nil))
+
+	c, err := config.FromYaml(clickhouseNativeConf)
+	util.Must(err)
+	cc, err := multi_canal.NewMultiCanal(c[0])
+	util.Must(err)
+	util.Must(cc.Run())
+
+	<-(chan interface{})(nil)
+}
+
+const clickhouseMappingConf = `
+config:
+  - ingress:
+      driver: fake_ingress
+      dsn: ""
+
+    canalConfig:
+      name: test_ch_mapping
+      maxWaitTime: 3000
+      maxDataBatch: 10
+
+      retryOption:
+        maxInterval: 3000
+        multiplier: 1.5
+        initialInterval: 1000
+
+    egress:
+      - driver: clickhouse_egress
+        url: "tcp://172.17.0.2:9000?database=test&username=root&password=root"
+        hookChain:
+          - "chMappingHk()"
+        options:
+          autoCreateTable: true
+          tables:
+            shop.ttt:
+              target: test_mapping
+              strategy: replacing
+              columnRename:
+                name: user_name
+              columnExclude:
+                - secret
+              orderBy:
+                - id
+              columnType:
+                id: UInt64
+
+
+logLevel: "info"
+`
+
+/*
+auto created table:
+CREATE TABLE IF NOT EXISTS test_mapping
+(
+    `id` UInt64,
+    `user_name` String,
+    `_version` UInt64,
+    `_is_deleted` UInt8
+)
+ENGINE = ReplacingMergeTree(_version, _is_deleted)
+ORDER BY (id)
+*/
+
+func TestClickhouseEgressMapping(t *testing.T) {
+	util.Must(register.RegisterHook(func(ctx *hook.Ctx, args []interface{}) error {
+		ctx.ForEach(func(data *driver.Data) (drop bool, stop bool) {
+			data.Database.Name = "shop"
+			data.RawMap["id"] = i
+			data.RawMap["secret"] = "not write"
+			i += 1
+			return false, false
+		})
+		return nil
+	}, "chMappingHk", nil))
+
+	c, err := config.FromYaml(clickhouseMappingConf)
+	util.Must(err)
+	cc, err := multi_canal.NewMultiCanal(c[0])
+	util.Must(err)
+	util.Must(cc.Run())
+
+	<-(chan interface{})(nil)
+}
+
+const clickhouseTargetDbConf = `
+config:
+  - ingress:
+      driver: fake_ingress
+      dsn: ""
+
+    canalConfig:
+      name: test_ch_target_db
+      maxWaitTime: 3000
+      maxDataBatch: 10
+
+      retryOption:
+        maxInterval: 3000
+        multiplier: 1.5
+        initialInterval: 1000
+
+    egress:
+      - driver: clickhouse_egress
+        url: "tcp://172.17.0.2:9000?database=test&username=root&password=root"
+        hookChain:
+          - "chTargetDbHk()"
+        options:
+          autoCreateTable: true
+          targetDatabase: "ods_{database}"
+          tables:
+            ttt:
+              orderBy:
+                - id
+
+
+logLevel: "info"
+`
+
+// rows of db1.ttt and db2.ttt write to ods_db1.ttt and ods_db2.ttt
+func TestClickhouseEgressTargetDatabase(t *testing.T) {
+	util.Must(register.RegisterHook(func(ctx *hook.Ctx, args []interface{}) error {
+		ctx.ForEach(func(data *driver.Data) (drop bool, stop bool) {
+			data.Database.Name = fmt.Sprintf("db%d", i%2+1)
+			data.RawMap["id"] = i
+			i += 1
+			return false, false
+		})
+		return nil
+	}, "chTargetDbHk", nil))
+
+	c, err := config.FromYaml(clickhouseTargetDbConf)
+	util.Must(err)
+	cc, err := multi_canal.NewMultiCanal(c[0])
+	util.Must(err)
+	util.Must(cc.Run())
+
+	<-(chan interface{})(nil)
+}
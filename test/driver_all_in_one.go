@@ -3,6 +3,12 @@ package test
 import (
 	_ "github.com/enustah/db-canal/driver/builtin/egress/clickhouse"
 	_ "github.com/enustah/db-canal/driver/builtin/egress/elasticsearch"
+	_ "github.com/enustah/db-canal/driver/builtin/egress/file"
+	_ "github.com/enustah/db-canal/driver/builtin/egress/opensearch"
+	_ "github.com/enustah/db-canal/driver/builtin/egress/parquet"
+	_ "github.com/enustah/db-canal/driver/builtin/egress/postgres"
+	_ "github.com/enustah/db-canal/driver/builtin/egress/redis"
+	_ "github.com/enustah/db-canal/driver/builtin/egress/webhook"
 	_ "github.com/enustah/db-canal/driver/builtin/ingress/mysql"
 	"github.com/enustah/db-canal/register"
 	"github.com/enustah/db-canal/util"
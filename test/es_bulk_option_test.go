@@ -0,0 +1,92 @@
+package test
+
+import (
+	"github.com/enustah/db-canal/config"
+	"github.com/enustah/db-canal/driver"
+	"github.com/enustah/db-canal/util"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEsEgressBulkOption(t *testing.T) {
+	server := newFakeEsServer()
+	defer server.Close()
+	egress := newEsEgress(server.URL, map[string]interface{}{
+		"idColumn":          map[string]interface{}{"User": "name"},
+		"ignoreConflict409": true,
+		"indices": map[string]interface{}{
+			"User": map[string]interface{}{
+				"routingColumn": "id",
+				"pipeline":      "user-pipeline",
+				"versionColumn": "updated_at",
+				"versionType":   "external_gte",
+			},
+		},
+	})
+	defer egress.Stop()
+
+	updatedAt := time.UnixMilli(1656000000000)
+	newData := func(name string) *driver.Data {
+		d := newEsTestData("shop", 7, time.Now())
+		d.RawMap["name"] = name
+		d.RawMap["updated_at"] = updatedAt
+		return d
+	}
+	// the conflict doc is ignored, two batch reuse the same bulk indexer
+	util.Must(egress.WriteData([]*driver.Data{newData("a"), newData("conflict")}))
+	util.Must(egress.WriteData([]*driver.Data{newData("b")}))
+
+	if len(server.actions) != 3 {
+		t.Fatalf("expect 3 bulk items, got %d", len(server.actions))
+	}
+	for i, v := range server.actions {
+		meta := v["index"]
+		if meta["routing"] != "7" || meta["version"] != float64(updatedAt.UnixMilli()) || meta["version_type"] != "external_gte" {
+			t.Errorf("unexpect item meta %v", meta)
+		}
+		if server.pipelines[i] != "user-pipeline" {
+			t.Errorf("expect pipeline user-pipeline, got %s", server.pipelines[i])
+		}
+	}
+
+	// 409 is not ignored by default. the driver is singleton, stop the bulk indexers before Init again
+	egress.Stop()
+	util.Must(egress.Init(config.EgressConfig{
+		Driver:  "elasticsearch_egress",
+		Url:     server.URL,
+		Options: map[string]interface{}{"idColumn": map[string]interface{}{"User": "name"}},
+	}))
+	util.Must(egress.Start())
+	if err := egress.WriteData([]*driver.Data{newData("conflict")}); err == nil {
+		t.Errorf("expect error of version conflict")
+	}
+}
+
+func TestEsEgressBulkAbort(t *testing.T) {
+	server := newFakeEsServer()
+	defer server.Close()
+	egress := newEsEgress(server.URL, map[string]interface{}{
+		"idColumn":      map[string]interface{}{"User": "name"},
+		"numWorkers":    1,
+		"flushBytes":    300,
+		"flushInterval": "60s",
+	})
+	defer egress.Stop()
+
+	// the big item flush alone and fail, the small items left in bulk indexer
+	big := newEsTestData("shop", 1, time.Now())
+	big.RawMap["name"] = strings.Repeat("a", 400)
+	server.lock.Lock()
+	server.failBulk = 1
+	server.lock.Unlock()
+	if err := egress.WriteData([]*driver.Data{big, newEsTestData("shop", 2, time.Now()), newEsTestData("shop", 3, time.Now())}); err == nil {
+		t.Fatalf("expect error of bulk request fail")
+	}
+	// the left items are flushed before WriteData return, not after the retry of batch
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	if len(server.actions) != 2 {
+		t.Errorf("expect 2 left items flushed before return, got %d", len(server.actions))
+	}
+}
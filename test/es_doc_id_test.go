@@ -0,0 +1,64 @@
+package test
+
+import (
+	"github.com/enustah/db-canal/config"
+	"github.com/enustah/db-canal/driver"
+	"github.com/enustah/db-canal/register"
+	"github.com/enustah/db-canal/util"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestEsEgressCompositeID(t *testing.T) {
+	server := newFakeEsServer()
+	defer server.Close()
+	egress := newEsEgress(server.URL, map[string]interface{}{
+		"idColumn": map[string]interface{}{
+			"order_item": []interface{}{"order_id", "sku", "created_at"},
+		},
+		"idSeparator": ":",
+	})
+	defer egress.Stop()
+
+	util.Must(egress.WriteData([]*driver.Data{{
+		Event: driver.EventInsert,
+		RawMap: map[string]interface{}{
+			"order_id":   uint64(math.MaxUint64),
+			"sku":        []byte{0xab, 0x01},
+			"created_at": time.Date(2022, 1, 2, 3, 4, 5, 0, time.UTC),
+			"count":      int64(1),
+		},
+		Table:    &driver.Table{Name: "order_item"},
+		Database: &driver.Database{Name: "shop"},
+	}}))
+
+	if len(server.actions) != 1 {
+		t.Fatalf("expect 1 bulk item, got %d", len(server.actions))
+	}
+	expect := "18446744073709551615:ab01:2022-01-02T03:04:05Z"
+	if id := server.actions[0]["index"]["_id"]; id != expect {
+		t.Errorf("expect id %s, got %v", expect, id)
+	}
+
+	// table without id column config return error instead of panic
+	err := egress.WriteData([]*driver.Data{newEsTestData("shop", 1, time.Now())})
+	if err == nil {
+		t.Errorf("expect error of id column not config")
+	}
+}
+
+func TestEsEgressIDColumnConfigError(t *testing.T) {
+	d, err := register.RegisterGetDriver("elasticsearch_egress", driver.TypeEgress)
+	util.Must(err)
+	err = d.(driver.EgressDriver).Init(config.EgressConfig{
+		Driver: "elasticsearch_egress",
+		Url:    "http://127.0.0.1:9200",
+		Options: map[string]interface{}{
+			"idColumn": map[string]interface{}{"user": 1},
+		},
+	})
+	if err == nil {
+		t.Errorf("expect init error of invalid id column")
+	}
+}
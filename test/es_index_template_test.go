@@ -0,0 +1,175 @@
+package test
+
+import (
+	"bufio"
+	"encoding/json"
+	"github.com/enustah/db-canal/config"
+	"github.com/enustah/db-canal/driver"
+	"github.com/enustah/db-canal/register"
+	"github.com/enustah/db-canal/util"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeEsServer accept bulk request and record the action of every item
+type fakeEsServer struct {
+	*httptest.Server
+	lock *sync.Mutex
+	// action meta of bulk items, e.g. {"index":{"_index":"a","_id":"1"}}
+	actions []map[string]map[string]interface{}
+	// body of bulk items, nil for delete
+	bodies []map[string]interface{}
+	// pipeline of bulk items
+	pipelines []string
+	// X-Elastic-Product header of response, empty for opensearch
+	product string
+	// request method and path except bulk
+	requests []string
+	// the number of bulk request return 500
+	failBulk int
+}
+
+func newFakeEsServer() *fakeEsServer {
+	f := &fakeEsServer{lock: &sync.Mutex{}, product: "Elasticsearch"}
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f.lock.Lock()
+		defer f.lock.Unlock()
+		if f.product != "" {
+			w.Header().Set("X-Elastic-Product", f.product)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.URL.Path == "/":
+			w.Write([]byte(`{"version":{"number":"8.3.0"}}`))
+		case strings.HasSuffix(r.URL.Path, "/_bulk") && f.failBulk > 0:
+			f.failBulk--
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"error":"fail"}`))
+		case strings.HasSuffix(r.URL.Path, "/_bulk"):
+			var (
+				scanner = bufio.NewScanner(r.Body)
+				items   = make([]map[string]interface{}, 0)
+			)
+			for scanner.Scan() {
+				// the body of delete is empty line
+				if len(scanner.Bytes()) == 0 {
+					continue
+				}
+				meta := make(map[string]map[string]interface{})
+				util.Must(json.Unmarshal(scanner.Bytes(), &meta))
+				f.actions = append(f.actions, meta)
+				for action, m := range meta {
+					// doc id `conflict` return version conflict, `missing` return not found
+					status := 200
+					switch m["_id"] {
+					case "conflict":
+						status = 409
+					case "missing":
+						status = 404
+					}
+					items = append(items, map[string]interface{}{action: map[string]interface{}{"status": status}})
+					f.pipelines = append(f.pipelines, r.URL.Query().Get("pipeline"))
+					var body map[string]interface{}
+					if action != "delete" {
+						scanner.Scan()
+						util.Must(json.Unmarshal(scanner.Bytes(), &body))
+					}
+					f.bodies = append(f.bodies, body)
+				}
+			}
+			b, _ := json.Marshal(map[string]interface{}{"errors": true, "items": items})
+			w.Write(b)
+		default:
+			f.requests = append(f.requests, r.Method+" "+r.URL.Path)
+			w.Write([]byte(`{"acknowledged":true}`))
+		}
+	}))
+	return f
+}
+
+func newEsEgress(url string, options map[string]interface{}) driver.EgressDriver {
+	d, err := register.RegisterGetDriver("elasticsearch_egress", driver.TypeEgress)
+	util.Must(err)
+	egress := d.(driver.EgressDriver)
+	util.Must(egress.Init(config.EgressConfig{
+		Driver:  "elasticsearch_egress",
+		Url:     url,
+		Options: options,
+	}))
+	util.Must(egress.Start())
+	return egress
+}
+
+func newEsTestData(db string, id int64, eventTime time.Time) *driver.Data {
+	return &driver.Data{
+		Event: driver.EventInsert,
+		RawMap: map[string]interface{}{
+			"id":   id,
+			"name": "es",
+		},
+		Table: &driver.Table{
+			Name: "User",
+			Column: []*driver.Column{
+				{Name: "id", Type: driver.ColumnTypeNumber},
+				{Name: "name", Type: driver.ColumnTypeString},
+			},
+		},
+		Database: &driver.Database{Name: db},
+		Metadata: map[string]interface{}{driver.MetadataEventTime: eventTime},
+	}
+}
+
+func TestEsEgressIndexTemplate(t *testing.T) {
+	server := newFakeEsServer()
+	defer server.Close()
+	egress := newEsEgress(server.URL, map[string]interface{}{
+		"idColumn": map[string]interface{}{"User": "id"},
+		"indices": map[string]interface{}{
+			"User": map[string]interface{}{
+				"index": "{database}-{table}-{yyyy.MM}",
+				"alias": "{table}",
+			},
+			"log.User": map[string]interface{}{
+				"index":      "logs-user",
+				"dataStream": true,
+			},
+		},
+	})
+	defer egress.Stop()
+
+	util.Must(egress.WriteData([]*driver.Data{
+		newEsTestData("shop", 1, time.Date(2022, 1, 31, 0, 0, 0, 0, time.Local)),
+		newEsTestData("shop", 2, time.Date(2022, 2, 1, 0, 0, 0, 0, time.Local)),
+		newEsTestData("log", 3, time.Date(2022, 2, 1, 0, 0, 0, 0, time.Local)),
+	}))
+
+	index := make(map[string]string)
+	for _, v := range server.actions {
+		for action, meta := range v {
+			index[meta["_index"].(string)] = action
+		}
+	}
+	expect := map[string]string{
+		"shop-user-2022.01": "index",
+		"shop-user-2022.02": "index",
+		"logs-user":         "create",
+	}
+	for k, v := range expect {
+		if index[k] != v {
+			t.Errorf("expect %s action on index %s, got %v", v, k, index)
+		}
+	}
+	aliasCount := 0
+	for _, v := range server.requests {
+		if strings.HasSuffix(v, "/_aliases/user") {
+			aliasCount++
+		}
+	}
+	if aliasCount != 2 {
+		t.Errorf("expect 2 index add to alias, got %v", server.requests)
+	}
+}
@@ -0,0 +1,121 @@
+package test
+
+import (
+	"github.com/enustah/db-canal/driver"
+	"github.com/enustah/db-canal/util"
+	"testing"
+)
+
+func newEsOrderItem(event driver.Event, id, orderID int64) *driver.Data {
+	return &driver.Data{
+		Event: event,
+		RawMap: map[string]interface{}{
+			"id":       id,
+			"order_id": orderID,
+			"sku":      "sku",
+		},
+		Table:    &driver.Table{Name: "order_items"},
+		Database: &driver.Database{Name: "shop"},
+	}
+}
+
+func TestEsEgressNested(t *testing.T) {
+	server := newFakeEsServer()
+	defer server.Close()
+	egress := newEsEgress(server.URL, map[string]interface{}{
+		"nested": map[string]interface{}{
+			"shop.order_items": map[string]interface{}{
+				"parentIndex": "orders",
+				"parentKey":   []string{"order_id"},
+				"field":       "items",
+				"childKey":    []string{"id"},
+				"upsert":      true,
+			},
+		},
+	})
+	defer egress.Stop()
+
+	// the item move from order 10 to order 11
+	move := newEsOrderItem(driver.EventUpdate, 1, 11)
+	move.OldDataMap = newEsOrderItem(driver.EventInsert, 1, 10).RawMap
+	util.Must(egress.WriteData([]*driver.Data{
+		newEsOrderItem(driver.EventInsert, 1, 10),
+		move,
+		newEsOrderItem(driver.EventDelete, 1, 11),
+	}))
+
+	expect := []struct {
+		id     string
+		hasRow bool
+	}{{"10", true}, {"10", false}, {"11", true}, {"11", false}}
+	if len(server.actions) != len(expect) {
+		t.Fatalf("expect %d bulk items, got %d", len(expect), len(server.actions))
+	}
+	for i, v := range expect {
+		meta := server.actions[i]["update"]
+		if meta["_index"] != "orders" || meta["_id"] != v.id {
+			t.Errorf("item %d expect update orders/%s, got %v", i, v.id, server.actions[i])
+		}
+		params := server.bodies[i]["script"].(map[string]interface{})["params"].(map[string]interface{})
+		if (params["row"] != nil) != v.hasRow || params["match"] == nil || params["field"] != "items" {
+			t.Errorf("item %d unexpect script params %v", i, params)
+		}
+		if server.bodies[i]["scripted_upsert"] != true {
+			t.Errorf("item %d expect scripted upsert", i)
+		}
+	}
+}
+
+func TestEsEgressNestedRouting(t *testing.T) {
+	server := newFakeEsServer()
+	defer server.Close()
+	options := func(ignoreMissing bool) map[string]interface{} {
+		return map[string]interface{}{
+			"indices": map[string]interface{}{
+				"order_items": map[string]interface{}{
+					"routingColumn": "tenant",
+					"pipeline":      "item-pipeline",
+				},
+			},
+			"nested": map[string]interface{}{
+				"order_items": map[string]interface{}{
+					"parentIndex":         "orders",
+					"parentKey":           []string{"order_id"},
+					"field":               "items",
+					"childKey":            []string{"id"},
+					"ignoreMissingParent": ignoreMissing,
+				},
+			},
+		}
+	}
+	row := func(event driver.Event, orderID interface{}, tenant string) *driver.Data {
+		d := newEsOrderItem(event, 1, 0)
+		d.RawMap["order_id"] = orderID
+		d.RawMap["tenant"] = tenant
+		return d
+	}
+	egress := newEsEgress(server.URL, options(true))
+
+	// the item move to the order of another tenant, the old parent use the routing of old row
+	move := row(driver.EventUpdate, int64(11), "t2")
+	move.OldDataMap = row(driver.EventInsert, int64(10), "t1").RawMap
+	util.Must(egress.WriteData([]*driver.Data{move, row(driver.EventInsert, "missing", "t1")}))
+	expect := []struct{ id, routing string }{{"10", "t1"}, {"11", "t2"}, {"missing", "t1"}}
+	if len(server.actions) != len(expect) {
+		t.Fatalf("expect %d bulk items, got %d", len(expect), len(server.actions))
+	}
+	for i, v := range expect {
+		meta := server.actions[i]["update"]
+		if meta["_id"] != v.id || meta["routing"] != v.routing || server.pipelines[i] != "item-pipeline" {
+			t.Errorf("item %d expect %s routing %s, got %v pipeline %s", i, v.id, v.routing, meta, server.pipelines[i])
+		}
+	}
+
+	// missing parent fail by default
+	egress.Stop()
+	egress = newEsEgress(server.URL, options(false))
+	defer egress.Stop()
+	if err := egress.WriteData([]*driver.Data{row(driver.EventInsert, "missing", "t1")}); err == nil {
+		t.Errorf("expect error of missing parent")
+	}
+}
@@ -0,0 +1,63 @@
+package test
+
+import (
+	"github.com/enustah/db-canal/driver"
+	"github.com/enustah/db-canal/util"
+	"testing"
+	"time"
+)
+
+func TestEsEgressPartialUpdate(t *testing.T) {
+	server := newFakeEsServer()
+	defer server.Close()
+	egress := newEsEgress(server.URL, map[string]interface{}{
+		"idColumn": map[string]interface{}{"User": "id", "counter": "id"},
+		"indices": map[string]interface{}{
+			"User": map[string]interface{}{
+				"updateMode":  "update",
+				"docAsUpsert": true,
+			},
+			"counter": map[string]interface{}{
+				"script": map[string]interface{}{
+					"source": "ctx._source.count += params.step",
+					"params": map[string]interface{}{"step": 1},
+				},
+			},
+		},
+	})
+	defer egress.Stop()
+
+	update := newEsTestData("shop", 1, time.Now())
+	update.Event = driver.EventUpdate
+	update.RawMap["age"] = int64(2)
+	update.OldDataMap = map[string]interface{}{"id": int64(1), "name": "es", "age": int64(1)}
+	// nothing changed, skip
+	noChange := newEsTestData("shop", 2, time.Now())
+	noChange.Event = driver.EventUpdate
+	noChange.OldDataMap = util.DeepCopyMap(noChange.RawMap)
+	script := newEsTestData("shop", 3, time.Now())
+	script.Table.Name = "counter"
+
+	util.Must(egress.WriteData([]*driver.Data{newEsTestData("shop", 1, time.Now()), update, noChange, script}))
+
+	if len(server.actions) != 3 {
+		t.Fatalf("expect 3 bulk items, got %d", len(server.actions))
+	}
+	for i, v := range server.actions {
+		if _, ok := v["update"]; !ok {
+			t.Errorf("expect update action, got %v", v)
+		}
+		if i < 2 && server.bodies[i]["doc_as_upsert"] != true {
+			t.Errorf("expect doc_as_upsert, got %v", server.bodies[i])
+		}
+	}
+	doc := server.bodies[1]["doc"].(map[string]interface{})
+	if len(doc) != 1 || doc["age"] != float64(2) {
+		t.Errorf("expect only changed column in doc, got %v", doc)
+	}
+	s := server.bodies[2]["script"].(map[string]interface{})
+	params := s["params"].(map[string]interface{})
+	if s["lang"] != "painless" || params["step"] != float64(1) || params["row"] == nil {
+		t.Errorf("unexpect script %v", s)
+	}
+}
@@ -0,0 +1,77 @@
+package test
+
+import (
+	"compress/gzip"
+	"encoding/csv"
+	"github.com/enustah/db-canal/config"
+	"github.com/enustah/db-canal/driver"
+	"github.com/enustah/db-canal/register"
+	"github.com/enustah/db-canal/util"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newFileTestData(id int64) *driver.Data {
+	return &driver.Data{
+		Event: driver.EventInsert,
+		RawMap: map[string]interface{}{
+			"id":   id,
+			"name": "file",
+		},
+		Table: &driver.Table{
+			Name: "user",
+			Column: []*driver.Column{
+				{Name: "id", Type: driver.ColumnTypeNumber},
+				{Name: "name", Type: driver.ColumnTypeString},
+			},
+		},
+		Database: &driver.Database{Name: "test"},
+	}
+}
+
+func TestFileEgress(t *testing.T) {
+	dir := t.TempDir()
+	d, err := register.RegisterGetDriver("file_egress", driver.TypeEgress)
+	util.Must(err)
+	egress := d.(driver.EgressDriver)
+	util.Must(egress.Init(config.EgressConfig{
+		Driver: "file_egress",
+		Url:    dir,
+		Options: map[string]interface{}{
+			"format":      "csv",
+			"partition":   "2006",
+			"gzip":        true,
+			"maxFileSize": 1,
+		},
+	}))
+	util.Must(egress.Start())
+
+	// the first batch write to one file, the second batch rotate to a new file
+	util.Must(egress.WriteData([]*driver.Data{newFileTestData(1), newFileTestData(2)}))
+	util.Must(egress.WriteData([]*driver.Data{newFileTestData(3)}))
+	egress.Stop()
+
+	files, err := filepath.Glob(filepath.Join(dir, "test", "user", "*", "*.csv.gz"))
+	util.Must(err)
+	if len(files) != 2 {
+		t.Fatalf("expect 2 files, got %d", len(files))
+	}
+	rows := 0
+	for _, v := range files {
+		f, err := os.Open(v)
+		util.Must(err)
+		gz, err := gzip.NewReader(f)
+		util.Must(err)
+		records, err := csv.NewReader(gz).ReadAll()
+		util.Must(err)
+		f.Close()
+		if records[0][0] != "_event" || records[0][1] != "id" {
+			t.Errorf("unexpect header %v", records[0])
+		}
+		rows += len(records) - 1
+	}
+	if rows != 3 {
+		t.Errorf("expect 3 rows, got %d", rows)
+	}
+}
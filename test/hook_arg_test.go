@@ -0,0 +1,125 @@
+package test
+
+import (
+	"github.com/enustah/db-canal/canal"
+	"github.com/enustah/db-canal/config"
+	"github.com/enustah/db-canal/driver"
+	"github.com/enustah/db-canal/hook"
+	"github.com/enustah/db-canal/register"
+	"github.com/enustah/db-canal/util"
+	"reflect"
+	"regexp"
+	"testing"
+	"time"
+)
+
+const hookArgConf = `
+config:
+  - ingress:
+      driver: fake_ingress
+      dsn: ""
+    egress:
+      - driver: fake_egress
+        hookChain:
+          - "argHk(1, 2.5, true, 1m, 'a,b', [x, 'y,z'], tag=t1)"
+          - name: argHk
+            args:
+              count: 3
+              ratio: 1
+              enable: false
+              interval: 30s
+              pattern: "order_\\d{1,3}"
+              list: [a, b]
+              tag: [t1, t2]
+          - name: argHk
+            args: [4, 0.5, true, 2s, "\\w+", c]
+`
+
+func TestHookArg(t *testing.T) {
+	var got [][]interface{}
+	util.Must(register.RegisterHookSpec(func(ctx *hook.Ctx, args []interface{}) error {
+		got = append(got, args)
+		return nil
+	}, "argHk", []hook.ArgSpec{
+		{Name: "count", Type: hook.ArgTypeInt},
+		{Name: "ratio", Type: hook.ArgTypeFloat},
+		{Name: "enable", Type: hook.ArgTypeBool},
+		{Name: "interval", Type: hook.ArgTypeDuration},
+		{Name: "pattern", Type: hook.ArgTypeRegexp},
+		{Name: "list", Type: hook.ArgTypeList | hook.ArgOptional, Default: "[d]"},
+		{Name: "tag", Type: hook.ArgTypeStr | hook.ArgOptional | hook.ArgVariadic},
+	}))
+
+	c, err := config.FromYaml(hookArgConf)
+	util.Must(err)
+	hc, err := canal.ParseHookConfig(c[0].Egress[0].HookChain)
+	util.Must(err)
+	_, err = hc.PassThrough([]*driver.Data{})
+	util.Must(err)
+
+	expect := [][]interface{}{
+		{int64(1), 2.5, true, time.Minute, regexp.MustCompile("a,b"), []string{"x", "y,z"}, "t1"},
+		{int64(3), float64(1), false, 30 * time.Second, regexp.MustCompile(`order_\d{1,3}`), []string{"a", "b"}, "t1", "t2"},
+		{int64(4), 0.5, true, 2 * time.Second, regexp.MustCompile(`\w+`), []string{"c"}},
+	}
+	if len(got) != len(expect) {
+		t.Fatalf("expect %d hook run, got %d", len(expect), len(got))
+	}
+	for i := range expect {
+		if len(got[i]) != len(expect[i]) {
+			t.Errorf("hook %d expect args %v, got %v", i, expect[i], got[i])
+			continue
+		}
+		for j := range expect[i] {
+			e, g := expect[i][j], got[i][j]
+			if re, ok := e.(*regexp.Regexp); ok {
+				if gr, ok := g.(*regexp.Regexp); !ok || gr.String() != re.String() {
+					t.Errorf("hook %d arg %d expect %v, got %v", i, j, e, g)
+				}
+			} else if !reflect.DeepEqual(e, g) {
+				t.Errorf("hook %d arg %d expect %#v, got %#v", i, j, e, g)
+			}
+		}
+	}
+
+	// optional arg use default, quoted string keep comma and backslash
+	got = nil
+	hc, err = canal.ParseHookChain([]string{`argHk(count=7, ratio=1.5, enable=1, interval=1s, pattern="a\"b\d")`})
+	util.Must(err)
+	_, err = hc.PassThrough([]*driver.Data{})
+	util.Must(err)
+	if len(got) != 1 || len(got[0]) != 6 || !reflect.DeepEqual(got[0][5], []string{"d"}) ||
+		got[0][4].(*regexp.Regexp).String() != `a"b\d` {
+		t.Errorf("named args wrong: %#v", got)
+	}
+
+	// string and structured form in one hook chain
+	if hs := c[0].Egress[0].HookChain; len(hs) != 3 || hs[0].Str == "" || hs[1].Name != "argHk" || len(hs[2].Args) != 6 {
+		t.Errorf("yaml hookChain parse wrong: %#v", hs)
+	}
+	got = nil
+	hc, err = canal.ParseHookConfig([]config.HookConfig{{Str: "argHk(5, 1, true, 1s, a)"}})
+	util.Must(err)
+	_, err = hc.PassThrough([]*driver.Data{})
+	util.Must(err)
+	if len(got) != 1 || got[0][0] != int64(5) {
+		t.Errorf("hook chain of go code wrong: %#v", got)
+	}
+
+	for _, v := range []string{
+		"argHk(1, 2.5, true, 1m)",
+		"argHk(x, 2.5, true, 1m, a)",
+		"argHk(1, 2.5, yes, 1m, a)",
+		"argHk(1, 2.5, true, 1, a)",
+		"argHk(1, 2.5, true, 1m, [)",
+		"argHk(1, 2.5, true, 1m, a, count=2)",
+		"argHk(count=1, 2.5, true, 1m, a)",
+		"delay(1x)",
+		"columnMask(-,-,a)",
+		"delay(1s, 2s)",
+	} {
+		if _, err := canal.ParseHookChain([]string{v}); err == nil {
+			t.Errorf("%s should fail", v)
+		}
+	}
+}
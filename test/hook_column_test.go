@@ -0,0 +1,85 @@
+package test
+
+import (
+	"github.com/enustah/db-canal/canal"
+	"github.com/enustah/db-canal/driver"
+	"github.com/enustah/db-canal/util"
+	"testing"
+)
+
+func newColumnTestData(table string) *driver.Data {
+	d := newFilterTestData("shop", table, driver.EventUpdate,
+		map[string]interface{}{"id": int64(1), "name": "alice", "email": "alice@example.com", "phone": "13800138000", "password": "pw"},
+		map[string]interface{}{"id": int64(1), "name": "alic", "email": "old@example.com", "phone": "13800138001", "password": "old"},
+	)
+	for _, v := range []string{"id", "name", "email", "phone", "password"} {
+		typ := driver.ColumnTypeString
+		if v == "id" {
+			typ = driver.ColumnTypeNumber
+		}
+		d.Table.Column = append(d.Table.Column, &driver.Column{Name: v, Type: typ})
+	}
+	return d
+}
+
+func columnNames(data *driver.Data) []string {
+	names := make([]string, 0, len(data.Table.Column))
+	for _, v := range data.Table.Column {
+		names = append(names, v.Name)
+	}
+	return names
+}
+
+func TestColumnHook(t *testing.T) {
+	hc, err := canal.ParseHookChain([]string{
+		"columnExclude(-,user,password)",
+		"columnInclude(shop,order,id,name)",
+		"columnRename(shop,-,name,user_name)",
+		"columnMask(-,user,email,hash)",
+		"columnMask(-,user,phone,truncate:3)",
+		"columnMask(-,user,id,redact)",
+	})
+	util.Must(err)
+	pass, err := hc.PassThrough([]*driver.Data{newColumnTestData("user"), newColumnTestData("order")})
+	util.Must(err)
+
+	user, order := pass[0], pass[1]
+	if names := columnNames(user); len(names) != 4 || names[1] != "user_name" {
+		t.Errorf("user column wrong: %v", names)
+	}
+	for _, m := range []map[string]interface{}{user.RawMap, user.OldDataMap} {
+		if _, ok := m["password"]; ok {
+			t.Errorf("password should be excluded: %v", m)
+		}
+		if _, ok := m["name"]; ok || m["user_name"] == nil {
+			t.Errorf("name should be renamed: %v", m)
+		}
+		if m["phone"] != "138" || m["id"] != "***" {
+			t.Errorf("phone or id not masked: %v", m)
+		}
+	}
+	if email := user.RawMap["email"].(string); len(email) != 64 || email == user.OldDataMap["email"] {
+		t.Errorf("email not hashed: %v", email)
+	}
+	if user.Table.Column[0].Type != driver.ColumnTypeString {
+		t.Errorf("masked id column type should be string")
+	}
+
+	if names := columnNames(order); len(names) != 2 || names[0] != "id" || names[1] != "user_name" {
+		t.Errorf("order column wrong: %v", names)
+	}
+	if len(order.RawMap) != 2 || len(order.OldDataMap) != 2 || order.RawMap["id"] != int64(1) || order.RawMap["user_name"] != "alice" {
+		t.Errorf("order data wrong: %v %v", order.RawMap, order.OldDataMap)
+	}
+
+	for _, v := range []string{
+		"columnInclude(-,-)",
+		"columnRename(-,-,a)",
+		"columnMask(-,-,a,base64)",
+		"columnMask(-,-,a,truncate:x)",
+	} {
+		if _, err := canal.ParseHookChain([]string{v}); err == nil {
+			t.Errorf("%s should fail", v)
+		}
+	}
+}
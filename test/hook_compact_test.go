@@ -0,0 +1,78 @@
+package test
+
+import (
+	"fmt"
+	"github.com/enustah/db-canal/canal"
+	"github.com/enustah/db-canal/driver"
+	"github.com/enustah/db-canal/util"
+	"testing"
+)
+
+func TestCompactHook(t *testing.T) {
+	hc, err := canal.ParseHookChain([]string{"compact(id)"})
+	util.Must(err)
+	row := func(table string, event driver.Event, id interface{}, name string, old map[string]interface{}) *driver.Data {
+		raw := map[string]interface{}{"name": name}
+		if id != nil {
+			raw["id"] = id
+		}
+		return newFilterTestData("db", table, event, raw, old)
+	}
+	pass, err := hc.PassThrough([]*driver.Data{
+		// insert + update -> insert
+		row("a", driver.EventInsert, int64(1), "a1", nil),
+		// update chain -> last update with earliest old
+		row("a", driver.EventUpdate, int64(2), "b1", map[string]interface{}{"id": int64(2), "name": "b0"}),
+		// insert + delete -> nothing
+		row("a", driver.EventInsert, int64(3), "c1", nil),
+		row("a", driver.EventUpdate, int64(1), "a2", map[string]interface{}{"id": int64(1), "name": "a1"}),
+		// same id on other table not merged
+		row("b", driver.EventInsert, int64(1), "x1", nil),
+		row("a", driver.EventUpdate, int64(2), "b2", map[string]interface{}{"id": int64(2), "name": "b1"}),
+		row("a", driver.EventDelete, int64(3), "c1", nil),
+		// delete + insert -> update
+		row("a", driver.EventDelete, int64(4), "d0", nil),
+		row("a", driver.EventInsert, int64(4), "d1", nil),
+		// no key column
+		row("a", driver.EventInsert, nil, "n1", nil),
+		row("a", driver.EventInsert, nil, "n2", nil),
+		// key changed by update end the compaction
+		row("a", driver.EventInsert, int64(5), "e1", nil),
+		row("a", driver.EventUpdate, int64(6), "e2", map[string]interface{}{"id": int64(5), "name": "e1"}),
+		row("a", driver.EventUpdate, int64(6), "e3", map[string]interface{}{"id": int64(6), "name": "e2"}),
+		// update + delete -> delete
+		row("a", driver.EventUpdate, int64(7), "f1", map[string]interface{}{"id": int64(7), "name": "f0"}),
+		row("a", driver.EventDelete, int64(7), "f1", nil),
+		// insert + delete then insert again
+		row("a", driver.EventInsert, int64(8), "g1", nil),
+		row("a", driver.EventDelete, int64(8), "g1", nil),
+		row("a", driver.EventInsert, int64(8), "g2", nil),
+	})
+	util.Must(err)
+
+	expect := []string{
+		"a insert 1 a2 <nil>",
+		"a update 2 b2 b0",
+		"b insert 1 x1 <nil>",
+		"a update 4 d1 d0",
+		"a insert <nil> n1 <nil>",
+		"a insert <nil> n2 <nil>",
+		"a insert 5 e1 <nil>",
+		"a update 6 e2 e1",
+		"a update 6 e3 e2",
+		"a delete 7 f1 <nil>",
+		"a insert 8 g2 <nil>",
+	}
+	got := make([]string, 0, len(pass))
+	for _, v := range pass {
+		got = append(got, fmt.Sprintf("%s %s %v %v %v", v.Table.Name, v.Event, v.RawMap["id"], v.RawMap["name"], v.OldDataMap["name"]))
+	}
+	if len(got) != len(expect) {
+		t.Fatalf("expect %v, got %v", expect, got)
+	}
+	for i := range expect {
+		if got[i] != expect[i] {
+			t.Errorf("index %d expect `%s`, got `%s`", i, expect[i], got[i])
+		}
+	}
+}
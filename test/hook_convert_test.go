@@ -0,0 +1,125 @@
+package test
+
+import (
+	"github.com/enustah/db-canal/canal"
+	"github.com/enustah/db-canal/driver"
+	"github.com/enustah/db-canal/util"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestConvertHook(t *testing.T) {
+	hc, err := canal.ParseHookChain([]string{
+		"convert(shop,order,status,int)",
+		"convert(shop,order,name,string)",
+		"convert(shop,order,created,int,ms)",
+		"convert(shop,order,extra,json)",
+		"convert(shop,order,updated,datetime,Asia/Shanghai)",
+		"convert(shop,order,paid,datetime,UTC)",
+		"convert(shop,order,amount,int)",
+	})
+	util.Must(err)
+
+	created := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	// the data of same event share the table
+	table := &driver.Table{
+		Name: "order",
+		Column: []*driver.Column{
+			{Name: "status", Type: driver.ColumnTypeEnum, Metadata: map[string]interface{}{driver.ColumnMetadataEnum: []string{"new", "paid", "done"}}},
+			{Name: "name", Type: driver.ColumnTypeBytes},
+			{Name: "created", Type: driver.ColumnDatetime, Metadata: map[string]interface{}{driver.ColumnMetadataTimeFormat: "2006-01-02 15:04:05"}},
+			{Name: "extra", Type: driver.ColumnTypeString},
+			{Name: "updated", Type: driver.ColumnDatetime},
+			{Name: "paid", Type: driver.ColumnTypeString},
+			{Name: "amount", Type: driver.ColumnTypeString},
+		},
+	}
+	row := func(status string, amount string) *driver.Data {
+		data := newFilterTestData("shop", "order", driver.EventUpdate, map[string]interface{}{
+			"status":  status,
+			"name":    []byte("apple"),
+			"created": created,
+			"extra":   `{"tags":["a","b"]}`,
+			"updated": created,
+			"paid":    "2024-01-01 08:00:00",
+			"amount":  amount,
+		}, map[string]interface{}{"status": "new", "name": nil})
+		data.Table = table
+		return data
+	}
+	pass, err := hc.PassThrough([]*driver.Data{row("paid", "12"), row("done", "7")})
+	util.Must(err)
+
+	if v := pass[0].RawMap["status"]; v != int64(2) {
+		t.Errorf("expect enum paid to 2, got %#v", v)
+	}
+	if v := pass[1].RawMap["status"]; v != int64(3) {
+		t.Errorf("expect enum done of shared table to 3, got %#v", v)
+	}
+	if v := pass[0].OldDataMap["status"]; v != int64(1) {
+		t.Errorf("expect old enum new to 1, got %#v", v)
+	}
+	if v, ok := pass[0].OldDataMap["name"]; !ok || v != nil {
+		t.Errorf("expect old nil name not converted, got %#v", v)
+	}
+	if v := pass[0].RawMap["name"]; v != "apple" {
+		t.Errorf("expect bytes to string, got %#v", v)
+	}
+	if v := pass[0].RawMap["created"]; v != created.UnixMilli() {
+		t.Errorf("expect datetime to unix ms, got %#v", v)
+	}
+	if v := pass[0].RawMap["extra"]; !reflect.DeepEqual(v, map[string]interface{}{"tags": []interface{}{"a", "b"}}) {
+		t.Errorf("expect string to json object, got %#v", v)
+	}
+	if v := pass[0].RawMap["updated"].(time.Time); !v.Equal(created) || v.Hour() != 8 || v.Location().String() != "Asia/Shanghai" {
+		t.Errorf("expect datetime shift to Asia/Shanghai, got %v", v)
+	}
+	if v := pass[0].RawMap["paid"].(time.Time); !v.Equal(created.Add(8 * time.Hour)) {
+		t.Errorf("expect string parsed in UTC, got %v", v)
+	}
+	if v := pass[0].RawMap["amount"]; v != int64(12) {
+		t.Errorf("expect string to int, got %#v", v)
+	}
+	if v := pass[1].RawMap["amount"]; v != int64(7) {
+		t.Errorf("expect string of shared table to int, got %#v", v)
+	}
+
+	expectType := map[string]driver.ColumnType{
+		"status":  driver.ColumnTypeNumber,
+		"name":    driver.ColumnTypeString,
+		"created": driver.ColumnTypeNumber,
+		"extra":   driver.ColumnTypeStruct,
+		"updated": driver.ColumnDatetime,
+		"paid":    driver.ColumnDatetime,
+		"amount":  driver.ColumnTypeNumber,
+	}
+	for _, c := range table.Column {
+		if c.Type != expectType[c.Name] {
+			t.Errorf("column %s expect type %v, got %v", c.Name, expectType[c.Name], c.Type)
+		}
+		_, hasEnum := c.Metadata[driver.ColumnMetadataEnum]
+		_, hasTimeFmt := c.Metadata[driver.ColumnMetadataTimeFormat]
+		if hasEnum || hasTimeFmt != (c.Type == driver.ColumnDatetime) {
+			t.Errorf("column %s get unexpected metadata %v", c.Name, c.Metadata)
+		}
+	}
+
+	// convert fail return error and change nothing
+	hc, err = canal.ParseHookChain([]string{"convert(shop,order,amount,int)"})
+	util.Must(err)
+	table = &driver.Table{Name: "order", Column: []*driver.Column{{Name: "amount", Type: driver.ColumnTypeString}}}
+	ok, bad := row("paid", "5"), row("paid", "x")
+	if _, err = hc.PassThrough([]*driver.Data{ok, bad}); err == nil {
+		t.Errorf("expect invalid int fail")
+	}
+	if ok.RawMap["amount"] != "5" || bad.RawMap["amount"] != "x" || table.Column[0].Type != driver.ColumnTypeString {
+		t.Errorf("expect nothing changed on fail, got %#v %#v %v", ok.RawMap["amount"], bad.RawMap["amount"], table.Column[0].Type)
+	}
+
+	for _, v := range []string{"convert(-,-,a,date)", "convert(-,-,a,int,day)", "convert(-,-,a,datetime,Mars/Base)"} {
+		if _, err = canal.ParseHookChain([]string{v}); err == nil {
+			t.Errorf("%s should fail", v)
+		}
+	}
+}
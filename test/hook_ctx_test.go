@@ -0,0 +1,134 @@
+package test
+
+import (
+	"fmt"
+	"github.com/enustah/db-canal/canal"
+	"github.com/enustah/db-canal/driver"
+	"github.com/enustah/db-canal/hook"
+	"github.com/enustah/db-canal/register"
+	"github.com/enustah/db-canal/util"
+	"testing"
+)
+
+func TestHookCtxEmit(t *testing.T) {
+	// explode items column to one row per item
+	util.Must(register.RegisterHook(func(ctx *hook.Ctx, args []interface{}) error {
+		ctx.ForEach(func(data *driver.Data) (drop bool, stop bool) {
+			items, ok := data.RawMap["items"].([]interface{})
+			if !ok {
+				return data.RawMap["id"] == int64(2), false
+			}
+			rows := make([]*driver.Data, 0, len(items))
+			for _, v := range items {
+				d := data.DeepCopy()
+				delete(d.RawMap, "items")
+				d.RawMap["item"] = v
+				rows = append(rows, d)
+			}
+			ctx.Replace(data, rows...)
+			return
+		})
+		return nil
+	}, "ctxExplode", nil))
+
+	// add an audit row after each update row, outside ForEach
+	util.Must(register.RegisterHook(func(ctx *hook.Ctx, args []interface{}) error {
+		var updates []*driver.Data
+		ctx.ForEach(func(data *driver.Data) (drop bool, stop bool) {
+			if data.Event == driver.EventUpdate {
+				updates = append(updates, data)
+			}
+			return
+		})
+		for _, v := range updates {
+			audit := v.DeepCopy()
+			audit.Table.Name = "audit"
+			ctx.InsertAfter(v, audit)
+		}
+		return nil
+	}, "ctxAudit", nil))
+
+	// sum amount per id, the group of id 5 is removed
+	util.Must(register.RegisterHook(func(ctx *hook.Ctx, args []interface{}) error {
+		ctx.Aggregate(func(data *driver.Data) (string, bool) {
+			if data.Table.Name != "sum" {
+				return "", false
+			}
+			return fmt.Sprint(data.RawMap["id"]), true
+		}, func(acc, data *driver.Data) *driver.Data {
+			if data.RawMap["id"] == int64(5) {
+				return nil
+			}
+			merged := acc.DeepCopy()
+			merged.RawMap["amount"] = acc.RawMap["amount"].(int64) + data.RawMap["amount"].(int64)
+			return merged
+		})
+		return nil
+	}, "ctxSum", nil))
+
+	hc, err := canal.ParseHookChain([]string{"ctxExplode()", "ctxAudit()", "ctxSum()"})
+	util.Must(err)
+	row := func(table string, event driver.Event, raw map[string]interface{}) *driver.Data {
+		return newFilterTestData("db", table, event, raw, nil)
+	}
+	pass, err := hc.PassThrough([]*driver.Data{
+		row("order", driver.EventInsert, map[string]interface{}{"id": int64(1), "items": []interface{}{"a", "b"}}),
+		row("order", driver.EventInsert, map[string]interface{}{"id": int64(2)}),
+		row("order", driver.EventUpdate, map[string]interface{}{"id": int64(3), "items": []interface{}{"c"}}),
+		row("sum", driver.EventInsert, map[string]interface{}{"id": int64(4), "amount": int64(1)}),
+		row("sum", driver.EventInsert, map[string]interface{}{"id": int64(5), "amount": int64(1)}),
+		row("sum", driver.EventInsert, map[string]interface{}{"id": int64(4), "amount": int64(2)}),
+		row("sum", driver.EventInsert, map[string]interface{}{"id": int64(5), "amount": int64(1)}),
+		row("sum", driver.EventInsert, map[string]interface{}{"id": int64(5), "amount": int64(7)}),
+		row("sum", driver.EventInsert, map[string]interface{}{"id": int64(4), "amount": int64(3)}),
+	})
+	util.Must(err)
+
+	expect := []string{"order:1:a", "order:1:b", "order:3:c", "audit:3:c", "sum:4:6", "sum:5:7"}
+	got := make([]string, 0, len(pass))
+	for _, v := range pass {
+		val := v.RawMap["item"]
+		if v.Table.Name == "sum" {
+			val = v.RawMap["amount"]
+		}
+		got = append(got, fmt.Sprintf("%s:%v:%v", v.Table.Name, v.RawMap["id"], val))
+	}
+	if fmt.Sprint(got) != fmt.Sprint(expect) {
+		t.Errorf("expect %v, got %v", expect, got)
+	}
+}
+
+func TestHookCtxPendingRow(t *testing.T) {
+	// op on the row added in the same ForEach
+	util.Must(register.RegisterHook(func(ctx *hook.Ctx, args []interface{}) error {
+		ctx.ForEach(func(data *driver.Data) (drop bool, stop bool) {
+			newRow := func(name string) *driver.Data {
+				d := data.DeepCopy()
+				d.Table.Name = name
+				return d
+			}
+			a, b := newRow("a"), newRow("b")
+			ctx.InsertAfter(data, a, b)
+			ctx.InsertAfter(a, newRow("a1"))
+			ctx.Replace(b, newRow("b1"), newRow("b2"))
+			return
+		})
+		return nil
+	}, "ctxPending", nil))
+
+	hc, err := canal.ParseHookChain([]string{"ctxPending()"})
+	util.Must(err)
+	pass, err := hc.PassThrough([]*driver.Data{
+		newFilterTestData("db", "x", driver.EventInsert, map[string]interface{}{}, nil),
+		newFilterTestData("db", "y", driver.EventInsert, map[string]interface{}{}, nil),
+	})
+	util.Must(err)
+	expect := []string{"x", "a", "a1", "b1", "b2", "y", "a", "a1", "b1", "b2"}
+	got := make([]string, 0, len(pass))
+	for _, v := range pass {
+		got = append(got, v.Table.Name)
+	}
+	if fmt.Sprint(got) != fmt.Sprint(expect) {
+		t.Errorf("expect %v, got %v", expect, got)
+	}
+}
@@ -0,0 +1,185 @@
+package test
+
+import (
+	"database/sql"
+	sqldriver "database/sql/driver"
+	"fmt"
+	"github.com/enustah/db-canal/canal"
+	"github.com/enustah/db-canal/driver"
+	"github.com/enustah/db-canal/util"
+	"io"
+	"math"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fake sql driver of user table, record the executed query
+type enrichFakeDriver struct {
+	lock    sync.Mutex
+	queries []string
+	users   map[int64]string
+}
+
+type enrichFakeConn struct{ d *enrichFakeDriver }
+
+type enrichFakeStmt struct {
+	d     *enrichFakeDriver
+	query string
+}
+
+type enrichFakeRows struct {
+	rows [][]sqldriver.Value
+	i    int
+}
+
+var enrichDriver = &enrichFakeDriver{users: map[int64]string{1: "alice", 2: "bob"}}
+
+func init() {
+	sql.Register("enrich_fake", enrichDriver)
+}
+
+func (d *enrichFakeDriver) Open(name string) (sqldriver.Conn, error) {
+	return &enrichFakeConn{d: d}, nil
+}
+
+func (d *enrichFakeDriver) takeQueries() []string {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	q := d.queries
+	d.queries = nil
+	return q
+}
+
+func (c *enrichFakeConn) Prepare(query string) (sqldriver.Stmt, error) {
+	return &enrichFakeStmt{d: c.d, query: query}, nil
+}
+func (c *enrichFakeConn) Close() error                 { return nil }
+func (c *enrichFakeConn) Begin() (sqldriver.Tx, error) { return nil, fmt.Errorf("not support") }
+
+func (s *enrichFakeStmt) Close() error  { return nil }
+func (s *enrichFakeStmt) NumInput() int { return -1 }
+func (s *enrichFakeStmt) Exec(args []sqldriver.Value) (sqldriver.Result, error) {
+	return nil, fmt.Errorf("not support")
+}
+func (s *enrichFakeStmt) Query(args []sqldriver.Value) (sqldriver.Rows, error) {
+	s.d.lock.Lock()
+	defer s.d.lock.Unlock()
+	s.d.queries = append(s.d.queries, fmt.Sprintf("%s %v", s.query, args))
+	rows := &enrichFakeRows{}
+	for _, v := range args {
+		// the name overflow int64
+		if v.(int64) == 4 {
+			rows.rows = append(rows.rows, []sqldriver.Value{v, uint64(math.MaxUint64)})
+		}
+		if name, ok := s.d.users[v.(int64)]; ok {
+			rows.rows = append(rows.rows, []sqldriver.Value{v, []byte(name)})
+		}
+	}
+	return rows, nil
+}
+
+func (r *enrichFakeRows) Columns() []string { return []string{"id", "user_name"} }
+func (r *enrichFakeRows) Close() error      { return nil }
+func (r *enrichFakeRows) Next(dest []sqldriver.Value) error {
+	if r.i >= len(r.rows) {
+		return io.EOF
+	}
+	copy(dest, r.rows[r.i])
+	r.i++
+	return nil
+}
+func (r *enrichFakeRows) ColumnTypeScanType(index int) reflect.Type {
+	if index == 0 {
+		return reflect.TypeOf(int64(0))
+	}
+	return reflect.TypeOf("")
+}
+
+func TestEnrichHook(t *testing.T) {
+	hc, err := canal.ParseHookChain([]string{
+		`enrich(enrich_fake,fake,shop,order,"SELECT id, name AS user_name FROM user",[user_id],[id],ttl=200ms)`,
+	})
+	util.Must(err)
+	row := func(table string, userId interface{}) *driver.Data {
+		raw := map[string]interface{}{}
+		if userId != nil {
+			raw["user_id"] = userId
+		}
+		return newFilterTestData("shop", table, driver.EventInsert, raw, nil)
+	}
+
+	// the result columns resolve before any lookup
+	pass, err := hc.PassThrough([]*driver.Data{row("order", nil)})
+	util.Must(err)
+	if v, ok := pass[0].RawMap["user_name"]; !ok || v != nil || len(pass[0].Table.Column) != 1 {
+		t.Errorf("expect nil user_name of row without key, got %v exist %v", v, ok)
+	}
+	if queries := enrichDriver.takeQueries(); len(queries) != 1 ||
+		queries[0] != "SELECT * FROM (SELECT id, name AS user_name FROM user) enrich_t WHERE 1 = 0 []" {
+		t.Errorf("unexpected resolve queries %v", queries)
+	}
+
+	pass, err = hc.PassThrough([]*driver.Data{
+		row("order", int64(1)),
+		row("order", uint64(2)),
+		row("order", int64(1)),
+		// not found in source
+		row("order", int64(3)),
+		// no key column
+		row("order", nil),
+		// table not match
+		row("user", int64(1)),
+	})
+	util.Must(err)
+	expect := []interface{}{"alice", "bob", "alice", nil, nil, nil}
+	for i, v := range pass {
+		name, ok := v.RawMap["user_name"]
+		// every enriched row has the column, nil if not found
+		if name != expect[i] || ok != (i < 5) {
+			t.Errorf("index %d expect user_name %v, got %v exist %v", i, expect[i], name, ok)
+		}
+		cols := v.Table.Column
+		if i < 5 && (len(cols) != 1 || cols[0].Name != "user_name" || cols[0].Type != driver.ColumnTypeString) {
+			t.Errorf("index %d expect user_name string column added, got %v", i, cols)
+		}
+	}
+	// unique keys lookup in one query
+	queries := enrichDriver.takeQueries()
+	if len(queries) != 1 ||
+		queries[0] != "SELECT * FROM (SELECT id, name AS user_name FROM user) enrich_t WHERE enrich_t.id IN (?, ?, ?) [1 2 3]" {
+		t.Errorf("unexpected queries %v", queries)
+	}
+
+	// found and not found key both cached
+	pass, err = hc.PassThrough([]*driver.Data{row("order", int64(2)), row("order", int64(3))})
+	util.Must(err)
+	if pass[0].RawMap["user_name"] != "bob" {
+		t.Errorf("expect cached user_name bob, got %v", pass[0].RawMap["user_name"])
+	}
+	if queries = enrichDriver.takeQueries(); len(queries) != 0 {
+		t.Errorf("expect cache hit, got queries %v", queries)
+	}
+
+	// expired key lookup again
+	time.Sleep(300 * time.Millisecond)
+	enrichDriver.lock.Lock()
+	enrichDriver.users[3] = "carol"
+	enrichDriver.lock.Unlock()
+	pass, err = hc.PassThrough([]*driver.Data{row("order", int64(3))})
+	util.Must(err)
+	if pass[0].RawMap["user_name"] != "carol" {
+		t.Errorf("expect user_name carol after ttl, got %v", pass[0].RawMap["user_name"])
+	}
+	if queries = enrichDriver.takeQueries(); len(queries) != 1 || !strings.HasSuffix(queries[0], "[3]") {
+		t.Errorf("expect lookup expired key, got queries %v", queries)
+	}
+
+	// the uint64 overflow int64 is error
+	if _, err = hc.PassThrough([]*driver.Data{row("order", int64(4))}); err == nil {
+		t.Errorf("expect uint64 overflow fail")
+	}
+	enrichDriver.takeQueries()
+}
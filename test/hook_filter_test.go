@@ -0,0 +1,88 @@
+package test
+
+import (
+	"github.com/enustah/db-canal/canal"
+	"github.com/enustah/db-canal/driver"
+	"github.com/enustah/db-canal/util"
+	"testing"
+	"time"
+)
+
+func newFilterTestData(db, table string, event driver.Event, raw, old map[string]interface{}) *driver.Data {
+	return &driver.Data{
+		Event:      event,
+		RawMap:     raw,
+		OldDataMap: old,
+		Table:      &driver.Table{Name: table},
+		Database:   &driver.Database{Name: db},
+		Metadata:   map[string]interface{}{driver.MetadataEventTime: time.Unix(1700000000, 0)},
+	}
+}
+
+func TestFilterHook(t *testing.T) {
+	data := []*driver.Data{
+		newFilterTestData("shop", "order_1", driver.EventInsert, map[string]interface{}{"status": int64(1), "amount": 200.5}, nil),
+		newFilterTestData("shop", "order_2", driver.EventInsert, map[string]interface{}{"status": int64(3), "amount": 200.5}, nil),
+		newFilterTestData("shop", "order_3", driver.EventUpdate, map[string]interface{}{"status": uint64(2), "amount": int64(101)}, map[string]interface{}{"status": uint64(1)}),
+		newFilterTestData("shop", "user", driver.EventInsert, map[string]interface{}{"status": int64(1), "amount": int64(1000)}, nil),
+		newFilterTestData("other", "order_1", driver.EventInsert, map[string]interface{}{"status": int64(1), "amount": int64(1000)}, nil),
+		newFilterTestData("shop", "order_4", driver.EventDelete, map[string]interface{}{"status": int64(2), "amount": int64(100)}, nil),
+	}
+
+	cases := []struct {
+		expr   string
+		expect []string
+	}{
+		{`db == "shop" && table =~ "order_.*" && status in (1,2) && amount > 100`, []string{"order_1", "order_3"}},
+		{`amount >= 101 && amount <= 200.5`, []string{"order_1", "order_2", "order_3"}},
+		{`event != "insert" && !(old.status == null)`, []string{"order_3"}},
+		{`new.status not in (1, 3) || db == 'other'`, []string{"order_3", "order_1", "order_4"}},
+		{`table !~ "^order_" || meta.eventTime < 1600000000`, []string{"user"}},
+		{`old.status`, []string{"order_3"}},
+	}
+	for _, c := range cases {
+		hc, err := canal.ParseHookChain([]string{"filter(" + c.expr + ")"})
+		util.Must(err)
+		batch := make([]*driver.Data, 0, len(data))
+		for _, v := range data {
+			batch = append(batch, v.DeepCopy())
+		}
+		pass, err := hc.PassThrough(batch)
+		util.Must(err)
+		if len(pass) != len(c.expect) {
+			t.Errorf("filter(%s) expect %d data, got %d", c.expr, len(c.expect), len(pass))
+			continue
+		}
+		for i, v := range pass {
+			if v.Table.Name != c.expect[i] {
+				t.Errorf("filter(%s) expect table %s at %d, got %s", c.expr, c.expect[i], i, v.Table.Name)
+			}
+		}
+	}
+
+	for _, v := range []string{
+		`filter(status ==)`,
+		`filter(table =~ status)`,
+		`filter(table =~ "(")`,
+		`filter(status in (1,2)`,
+		`filter("unclosed)`,
+	} {
+		if _, err := canal.ParseHookChain([]string{v}); err == nil {
+			t.Errorf("%s should fail", v)
+		}
+	}
+}
+
+func TestDataFilterHookGte(t *testing.T) {
+	hc, err := canal.ParseHookChain([]string{"dataFilter(-,-,id,>=,10)"})
+	util.Must(err)
+	pass, err := hc.PassThrough([]*driver.Data{
+		newFilterTestData("db", "t", driver.EventInsert, map[string]interface{}{"id": int64(9)}, nil),
+		newFilterTestData("db", "t", driver.EventInsert, map[string]interface{}{"id": int64(10)}, nil),
+		newFilterTestData("db", "t", driver.EventInsert, map[string]interface{}{"id": int64(11)}, nil),
+	})
+	util.Must(err)
+	if len(pass) != 1 || pass[0].RawMap["id"] != int64(9) {
+		t.Errorf("dataFilter id >= 10 should only pass id 9, got %d data", len(pass))
+	}
+}
@@ -0,0 +1,42 @@
+package test
+
+import (
+	"github.com/enustah/db-canal/canal"
+	"github.com/enustah/db-canal/driver"
+	"github.com/enustah/db-canal/util"
+	"testing"
+)
+
+func TestRouteHook(t *testing.T) {
+	hc, err := canal.ParseHookChain([]string{
+		`route(shop_(\d+),order_\d+,shop,order)`,
+		`route(-,(?P<name>user)_(\d+),-,${name}_shard${2})`,
+	})
+	util.Must(err)
+	cases := []struct {
+		db, table             string
+		expectDb, expectTable string
+	}{
+		{"shop_01", "order_12", "shop", "order"},
+		{"shop_01", "order_x", "shop_01", "order_x"},
+		{"shop_01", "sub_order_12", "shop_01", "sub_order_12"},
+		{"shop", "order_12", "shop", "order_12"},
+		{"other", "user_3", "other", "user_shard3"},
+	}
+	data := make([]*driver.Data, 0, len(cases))
+	for _, c := range cases {
+		data = append(data, newFilterTestData(c.db, c.table, driver.EventInsert, map[string]interface{}{}, nil))
+	}
+	pass, err := hc.PassThrough(data)
+	util.Must(err)
+	for i, c := range cases {
+		if pass[i].Database.Name != c.expectDb || pass[i].Table.Name != c.expectTable {
+			t.Errorf("%s.%s expect route to %s.%s, got %s.%s", c.db, c.table, c.expectDb, c.expectTable,
+				pass[i].Database.Name, pass[i].Table.Name)
+		}
+	}
+
+	if _, err = canal.ParseHookChain([]string{`route(-,order_[,-,order)`}); err == nil {
+		t.Errorf("invalid pattern should fail")
+	}
+}
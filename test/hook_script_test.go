@@ -0,0 +1,200 @@
+package test
+
+import (
+	"github.com/enustah/db-canal/canal"
+	"github.com/enustah/db-canal/driver"
+	"github.com/enustah/db-canal/util"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const rowScript = `
+function process(row)
+  if row.new.status == 0 then
+    return false
+  end
+  row.new.name = string.upper(row.new.name)
+  row.new.secret = nil
+  row.table = row.db .. "_" .. row.table
+  if row.old ~= nil then
+    row.new.old_name = row.old.name
+  end
+  -- explode tags to another table
+  if row.new.tags ~= nil then
+    for _, tag in ipairs(row.new.tags) do
+      emit({table = "tag", new = {id = row.new.id, tag = tag}})
+    end
+    row.new.tags = nil
+  end
+end
+`
+
+const batchScript = `
+function process_batch(rows)
+  for i, row in ipairs(rows) do
+    row.new.seq = i
+    if row.event == "delete" then
+      row.drop = true
+    end
+  end
+  emit({db = "db", table = "summary", new = {count = #rows}})
+end
+`
+
+const errorScript = `
+function process(row)
+  error("bad row " .. row.new.id)
+end
+`
+
+func writeScript(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "hook.lua")
+	util.Must(os.WriteFile(path, []byte(content), 0644))
+	return path
+}
+
+func TestScriptHookRow(t *testing.T) {
+	hc, err := canal.ParseHookChain([]string{"script(" + writeScript(t, rowScript) + ")"})
+	util.Must(err)
+	created := time.Unix(1700000000, 0)
+	pass, err := hc.PassThrough([]*driver.Data{
+		newFilterTestData("db", "user", driver.EventInsert,
+			map[string]interface{}{"id": int64(1), "name": "aa", "status": int64(1), "secret": "x", "created": created, "tags": []interface{}{"a", "b"}}, nil),
+		newFilterTestData("db", "user", driver.EventInsert,
+			map[string]interface{}{"id": int64(2), "name": "bb", "status": int64(0)}, nil),
+		newFilterTestData("db", "user", driver.EventUpdate,
+			map[string]interface{}{"id": uint64(3), "name": "cc", "status": int64(1)}, map[string]interface{}{"name": "c"}),
+	})
+	util.Must(err)
+	if len(pass) != 4 {
+		t.Fatalf("expect 4 data, got %d", len(pass))
+	}
+	first := pass[0]
+	if first.Table.Name != "db_user" || first.RawMap["name"] != "AA" {
+		t.Errorf("row not modified: %v %v", first.Table.Name, first.RawMap)
+	}
+	if _, ok := first.RawMap["secret"]; ok {
+		t.Errorf("secret should be removed")
+	}
+	if _, ok := first.RawMap["tags"]; ok {
+		t.Errorf("tags should be removed")
+	}
+	// unchanged value keep go type
+	if first.RawMap["created"] != created || first.RawMap["id"] != int64(1) {
+		t.Errorf("unchanged value type changed: %#v", first.RawMap)
+	}
+	// emitted rows follow the source row
+	if pass[3].RawMap["id"] != uint64(3) || pass[3].RawMap["old_name"] != "c" {
+		t.Errorf("update row not modified: %#v", pass[3].RawMap)
+	}
+	for i, tag := range []string{"a", "b"} {
+		d := pass[1+i]
+		if d.Table.Name != "tag" || d.Database.Name != "db" || d.RawMap["tag"] != tag || d.RawMap["id"] != int64(1) {
+			t.Errorf("emitted row %d wrong: %s.%s %#v", i, d.Database.Name, d.Table.Name, d.RawMap)
+		}
+	}
+}
+
+func TestScriptHookBatch(t *testing.T) {
+	hc, err := canal.ParseHookChain([]string{"script(" + writeScript(t, batchScript) + ")"})
+	util.Must(err)
+	pass, err := hc.PassThrough([]*driver.Data{
+		newFilterTestData("db", "user", driver.EventInsert, map[string]interface{}{"id": int64(1)}, nil),
+		newFilterTestData("db", "user", driver.EventDelete, map[string]interface{}{"id": int64(2)}, nil),
+		newFilterTestData("db", "user", driver.EventUpdate, map[string]interface{}{"id": int64(3)}, nil),
+	})
+	util.Must(err)
+	if len(pass) != 3 {
+		t.Fatalf("expect 3 data, got %d", len(pass))
+	}
+	if pass[0].RawMap["seq"] != int64(1) || pass[1].RawMap["seq"] != int64(3) {
+		t.Errorf("seq wrong: %v %v", pass[0].RawMap, pass[1].RawMap)
+	}
+	if pass[2].Table.Name != "summary" || pass[2].RawMap["count"] != int64(3) {
+		t.Errorf("emitted summary wrong: %s %v", pass[2].Table.Name, pass[2].RawMap)
+	}
+}
+
+func TestScriptHookError(t *testing.T) {
+	hc, err := canal.ParseHookChain([]string{"script(" + writeScript(t, errorScript) + ")"})
+	util.Must(err)
+	if _, err = hc.PassThrough([]*driver.Data{
+		newFilterTestData("db", "user", driver.EventInsert, map[string]interface{}{"id": int64(1)}, nil),
+	}); err == nil {
+		t.Errorf("script error should return")
+	}
+
+	for _, v := range []string{"function other() end", "function process("} {
+		if _, err = canal.ParseHookChain([]string{"script(" + writeScript(t, v) + ")"}); err == nil {
+			t.Errorf("script `%s` should load fail", v)
+		}
+	}
+}
+
+const columnScript = `
+function process(row)
+  if row.new.id == 3 then
+    error("bad row")
+  end
+  row.new.full_name = row.new.name .. "!"
+  row.new.secret = nil
+  row.new.created = row.new.created + 1
+end
+`
+
+func TestScriptHookColumn(t *testing.T) {
+	hc, err := canal.ParseHookChain([]string{"script(" + writeScript(t, columnScript) + ")"})
+	util.Must(err)
+	created := time.Unix(1700000000, 0)
+	// the rows of same event share the table
+	table := &driver.Table{
+		Name: "user",
+		Column: []*driver.Column{
+			{Name: "id", Type: driver.ColumnTypeNumber},
+			{Name: "name", Type: driver.ColumnTypeString},
+			{Name: "secret", Type: driver.ColumnTypeString},
+			{Name: "created", Type: driver.ColumnDatetime},
+		},
+	}
+	row := func(id int64) *driver.Data {
+		d := newFilterTestData("db", "user", driver.EventInsert,
+			map[string]interface{}{"id": id, "name": "aa", "secret": "x", "created": created}, nil)
+		d.Table = table
+		return d
+	}
+	pass, err := hc.PassThrough([]*driver.Data{row(1), row(2)})
+	util.Must(err)
+	expect := map[string]driver.ColumnType{
+		"id":        driver.ColumnTypeNumber,
+		"name":      driver.ColumnTypeString,
+		"created":   driver.ColumnTypeNumber,
+		"full_name": driver.ColumnTypeString,
+	}
+	for _, d := range pass {
+		if len(d.Table.Column) != len(expect) {
+			t.Errorf("expect columns %v, got %d", expect, len(d.Table.Column))
+		}
+		for _, c := range d.Table.Column {
+			if typ, ok := expect[c.Name]; !ok || typ != c.Type {
+				t.Errorf("column %s get unexpected type %v", c.Name, c.Type)
+			}
+		}
+		if d.RawMap["full_name"] != "aa!" || d.RawMap["created"] != created.Unix()+1 {
+			t.Errorf("row not modified: %#v", d.RawMap)
+		}
+	}
+	if len(table.Column) != 4 || table.Column[3].Type != driver.ColumnDatetime {
+		t.Errorf("shared table should not be modified: %v", table.Column)
+	}
+
+	// error of the later row leave the whole batch unchanged
+	data := []*driver.Data{row(1), row(3)}
+	if _, err = hc.PassThrough(data); err == nil {
+		t.Fatalf("script error should return")
+	}
+	if _, ok := data[0].RawMap["full_name"]; ok || data[0].RawMap["secret"] != "x" || data[0].Table != table {
+		t.Errorf("row changed by failed run: %#v", data[0].RawMap)
+	}
+}
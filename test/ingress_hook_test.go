@@ -0,0 +1,181 @@
+package test
+
+import (
+	"github.com/enustah/db-canal/canal/multi_canal"
+	"github.com/enustah/db-canal/config"
+	"github.com/enustah/db-canal/driver"
+	"github.com/enustah/db-canal/hook"
+	"github.com/enustah/db-canal/register"
+	"github.com/enustah/db-canal/util"
+	"sync"
+	"testing"
+	"time"
+)
+
+const ingressHookConf = `
+config:
+  - ingress:
+      driver: fake_ingress
+      hookChain:
+        - "inputHk()"
+
+    canalConfig:
+      name: test_ingress_hook
+      maxWaitTime: 1000
+      maxDataBatch: 2
+
+    egress:
+      - driver: fake_egress1
+        hookChain:
+          - "outputHk()"
+      - driver: fake_egress2
+        hookChain:
+          - "outputHk()"
+
+logLevel: "info"
+`
+
+func TestIngressHookChain(t *testing.T) {
+	var (
+		lock        sync.Mutex
+		inputRun    int
+		inputRows   int
+		outputRows  = make(map[*driver.Data]int)
+		outputCount int
+	)
+	util.Must(register.RegisterHook(func(ctx *hook.Ctx, args []interface{}) error {
+		lock.Lock()
+		defer lock.Unlock()
+		inputRun++
+		ctx.ForEach(func(data *driver.Data) (drop bool, stop bool) {
+			inputRows++
+			data.RawMap["name"] = "input"
+			// drop odd rows for all egress
+			return data.Metadata["i"].(int)%2 == 1, false
+		})
+		return nil
+	}, "inputHk", nil))
+	util.Must(register.RegisterHook(func(ctx *hook.Ctx, args []interface{}) error {
+		lock.Lock()
+		defer lock.Unlock()
+		ctx.ForEach(func(data *driver.Data) (drop bool, stop bool) {
+			if data.RawMap["name"] != "input" || data.Metadata["i"].(int)%2 == 1 {
+				t.Errorf("egress get data not pass input hook: %v %v", data.RawMap, data.Metadata)
+			}
+			outputRows[data]++
+			outputCount++
+			return
+		})
+		return nil
+	}, "outputHk", nil))
+
+	c, err := config.FromYaml(ingressHookConf)
+	util.Must(err)
+	cc, err := multi_canal.NewMultiCanal(c[0])
+	util.Must(err)
+	util.Must(cc.Run())
+	time.Sleep(3 * time.Second)
+	cc.Stop()
+
+	lock.Lock()
+	defer lock.Unlock()
+	if inputRun == 0 || inputRows == 0 {
+		t.Fatalf("input hook not run")
+	}
+	// each row pass input hook once, then copy to both egress
+	if outputCount != 2*(inputRows-inputRows/2) && outputCount != 2*(inputRows/2) {
+		t.Errorf("input rows %d, egress rows %d", inputRows, outputCount)
+	}
+	for data, n := range outputRows {
+		if n != 1 {
+			t.Errorf("data %v shared by egress", data.Metadata)
+		}
+	}
+}
+
+// sharedTableIngress send the rows of an event with the same table and database, like mysql_ingress
+type sharedTableIngress struct {
+	ch   chan *driver.Data
+	stop chan struct{}
+}
+
+func (s *sharedTableIngress) Init(config config.IngressConfig) error { return nil }
+
+func (s *sharedTableIngress) Start() (<-chan *driver.Data, error) {
+	s.ch, s.stop = make(chan *driver.Data), make(chan struct{})
+	go func() {
+		for {
+			table := &driver.Table{Name: "order", Column: []*driver.Column{{Name: "id", Type: driver.ColumnTypeNumber}}}
+			database := &driver.Database{Name: "shop"}
+			for i := 0; i < 3; i++ {
+				select {
+				case s.ch <- &driver.Data{
+					Event:    driver.EventInsert,
+					RawMap:   map[string]interface{}{"id": int64(i)},
+					Table:    table,
+					Database: database,
+					Metadata: map[string]interface{}{},
+				}:
+				case <-s.stop:
+					return
+				}
+			}
+		}
+	}()
+	return s.ch, nil
+}
+
+func (s *sharedTableIngress) SavePoint(data *driver.Data) error { return nil }
+
+func (s *sharedTableIngress) Stop() { close(s.stop) }
+
+const sharedTableIngressConf = `
+config:
+  - ingress:
+      driver: shared_table_ingress
+      hookChain:
+        - 'route(-,(.*),-,ods_${1})'
+
+    canalConfig:
+      name: test_shared_table
+      maxWaitTime: 200
+      maxDataBatch: 3
+
+    egress:
+      - driver: fake_egress1
+        hookChain:
+          - "sharedTableHk()"
+
+logLevel: "info"
+`
+
+func TestIngressHookSharedTable(t *testing.T) {
+	var (
+		lock   sync.Mutex
+		tables = make(map[string]int)
+	)
+	util.Must(register.RegisterIngressDriver("shared_table_ingress", &sharedTableIngress{}))
+	util.Must(register.RegisterHook(func(ctx *hook.Ctx, args []interface{}) error {
+		lock.Lock()
+		defer lock.Unlock()
+		ctx.ForEach(func(data *driver.Data) (drop bool, stop bool) {
+			tables[data.Table.Name]++
+			return
+		})
+		return nil
+	}, "sharedTableHk", nil))
+
+	c, err := config.FromYaml(sharedTableIngressConf)
+	util.Must(err)
+	cc, err := multi_canal.NewMultiCanal(c[0])
+	util.Must(err)
+	util.Must(cc.Run())
+	time.Sleep(time.Second)
+	cc.Stop()
+
+	lock.Lock()
+	defer lock.Unlock()
+	if len(tables) != 1 || tables["ods_order"] == 0 {
+		t.Errorf("expect route each row once, got %v", tables)
+	}
+}
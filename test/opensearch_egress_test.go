@@ -0,0 +1,50 @@
+package test
+
+import (
+	"github.com/enustah/db-canal/config"
+	"github.com/enustah/db-canal/driver"
+	"github.com/enustah/db-canal/register"
+	"github.com/enustah/db-canal/util"
+	"testing"
+	"time"
+)
+
+// opensearch response has no X-Elastic-Product header
+func TestOpensearchEgress(t *testing.T) {
+	server := newFakeEsServer()
+	server.product = ""
+	defer server.Close()
+
+	d, err := register.RegisterGetDriver("opensearch_egress", driver.TypeEgress)
+	util.Must(err)
+	egress := d.(driver.EgressDriver)
+	util.Must(egress.Init(config.EgressConfig{
+		Driver: "opensearch_egress",
+		Url:    server.URL,
+		Options: map[string]interface{}{
+			"idColumn":        map[string]interface{}{"User": "id"},
+			"ignoreDelete404": true,
+			"username":        "admin",
+			"password":        "admin",
+			"numWorkers":      1,
+		},
+	}))
+	util.Must(egress.Start())
+	defer egress.Stop()
+
+	util.Must(egress.WriteData([]*driver.Data{newEsTestData("shop", 1, time.Now())}))
+	if len(server.actions) != 1 || server.actions[0]["index"]["_index"] != "user" {
+		t.Errorf("unexpect bulk items %v", server.actions)
+	}
+
+	// elasticsearch egress reject the server
+	es := newFakeEsServer()
+	es.product = ""
+	defer es.Close()
+	d, err = register.RegisterGetDriver("elasticsearch_egress", driver.TypeEgress)
+	util.Must(err)
+	util.Must(d.(driver.EgressDriver).Init(config.EgressConfig{Driver: "elasticsearch_egress", Url: es.URL}))
+	if err = d.(driver.EgressDriver).Start(); err == nil {
+		t.Errorf("expect product check error")
+	}
+}
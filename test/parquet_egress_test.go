@@ -0,0 +1,188 @@
+package test
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/enustah/db-canal/config"
+	"github.com/enustah/db-canal/driver"
+	"github.com/enustah/db-canal/register"
+	"github.com/enustah/db-canal/util"
+	"github.com/xitongsys/parquet-go-source/local"
+	"github.com/xitongsys/parquet-go/reader"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func newParquetTestData(id int64) *driver.Data {
+	return &driver.Data{
+		Event: driver.EventInsert,
+		RawMap: map[string]interface{}{
+			"id":      id,
+			"name":    "parquet",
+			"price":   1.5,
+			"content": []byte{0x00, 0xff},
+			"created": time.Now(),
+			"remark":  nil,
+		},
+		Table: &driver.Table{
+			Name: "order",
+			Column: []*driver.Column{
+				{Name: "id", Type: driver.ColumnTypeNumber},
+				{Name: "name", Type: driver.ColumnTypeString},
+				{Name: "price", Type: driver.ColumnTypeFloat},
+				{Name: "content", Type: driver.ColumnTypeBytes},
+				{Name: "created", Type: driver.ColumnDatetime},
+				{Name: "remark", Type: driver.ColumnTypeString},
+			},
+		},
+		Database: &driver.Database{Name: "shop"},
+	}
+}
+
+/*
+output to minio:
+
+url: "s3://bucket/prefix"
+options:
+  stagingDir: /tmp/parquet_staging
+  endpoint: 127.0.0.1:9000
+  accessKey: minioadmin
+  secretKey: minioadmin
+*/
+
+func TestParquetEgress(t *testing.T) {
+	dir := t.TempDir()
+	d, err := register.RegisterGetDriver("parquet_egress", driver.TypeEgress)
+	util.Must(err)
+	egress := d.(driver.EgressDriver)
+	util.Must(egress.Init(config.EgressConfig{
+		Driver: "parquet_egress",
+		Url:    dir,
+		Options: map[string]interface{}{
+			"maxFileRows": 3,
+		},
+	}))
+	util.Must(egress.Start())
+	listFiles := func(table string) []string {
+		files, err := filepath.Glob(filepath.Join(dir, "shop", table, "*.parquet"))
+		util.Must(err)
+		return files
+	}
+
+	// rows are buffered across batches until the file reach maxFileRows
+	util.Must(egress.WriteData([]*driver.Data{newParquetTestData(1), newParquetTestData(2)}))
+	if files := listFiles("order"); len(files) != 0 {
+		t.Fatalf("expect rows buffered, got %d files", len(files))
+	}
+	util.Must(egress.WriteData([]*driver.Data{newParquetTestData(3), newParquetTestData(4), newParquetTestData(5), newParquetTestData(6)}))
+	if files := listFiles("order"); len(files) != 2 {
+		t.Fatalf("expect 2 files after reach maxFileRows, got %d", len(files))
+	}
+
+	// the fail batch is rollback, include the file replaced by the change of columns
+	util.Must(egress.WriteData([]*driver.Data{newParquetTestData(7)}))
+	changed := newParquetTestData(8)
+	changed.Table.Column = append(changed.Table.Column, &driver.Column{Name: "extra", Type: driver.ColumnTypeString})
+	bad := newParquetTestData(9)
+	bad.RawMap["id"] = "abc"
+	if err = egress.WriteData([]*driver.Data{changed, bad}); err == nil {
+		t.Errorf("expect write fail with invalid number")
+	}
+	if files := listFiles("order"); len(files) != 2 {
+		t.Fatalf("expect no file commit by fail batch, got %d", len(files))
+	}
+	util.Must(egress.WriteData([]*driver.Data{newParquetTestData(8)}))
+
+	// commit fail does not fail the batch of durable rows, the next batch fail until the file commit
+	failData := func(id int64) *driver.Data {
+		data := newParquetTestData(id)
+		data.Table.Name = "fail"
+		return data
+	}
+	util.Must(os.WriteFile(filepath.Join(dir, "shop", "fail"), nil, 0644))
+	util.Must(egress.WriteData([]*driver.Data{failData(1), failData(2), failData(3)}))
+	if err = egress.WriteData([]*driver.Data{failData(4)}); err == nil {
+		t.Errorf("expect write fail when last commit fail")
+	}
+	util.Must(os.Remove(filepath.Join(dir, "shop", "fail")))
+	util.Must(egress.WriteData([]*driver.Data{failData(4)}))
+	if files := listFiles("fail"); len(files) != 1 {
+		t.Errorf("expect 1 file after commit again, got %d", len(files))
+	}
+
+	// number changed to string by hook
+	str := newParquetTestData(10)
+	str.RawMap["id"] = "10"
+	// string of bytes column may be valid base64 but keep as it is
+	str.RawMap["content"] = "abcd"
+	util.Must(egress.WriteData([]*driver.Data{str}))
+	// stop commit the buffered rows
+	egress.Stop()
+
+	countRows := func(table string) (int64, map[string]bool) {
+		var rows int64
+		contents := make(map[string]bool)
+		for _, f := range listFiles(table) {
+			pf, err := local.NewLocalFileReader(f)
+			util.Must(err)
+			pr, err := reader.NewParquetReader(pf, nil, 1)
+			util.Must(err)
+			n := pr.GetNumRows()
+			rows += n
+			values, err := pr.ReadByNumber(int(n))
+			util.Must(err)
+			for _, v := range values {
+				contents[fmt.Sprintf("%v", reflect.ValueOf(v).FieldByName("Content").Elem().Interface())] = true
+			}
+			pr.ReadStop()
+			pf.Close()
+		}
+		return rows, contents
+	}
+	rows, contents := countRows("order")
+	if rows != 9 || len(listFiles("order")) != 3 {
+		t.Errorf("expect 9 rows in 3 files, got %d rows", rows)
+	}
+	if !contents["\x00\xff"] || !contents["abcd"] || len(contents) != 2 {
+		t.Errorf("unexpected bytes content %v", contents)
+	}
+	if rows, _ = countRows("fail"); rows != 4 {
+		t.Errorf("expect 4 rows of fail table, got %d", rows)
+	}
+	staging, _ := filepath.Glob(filepath.Join(dir, "_staging", "*"))
+	if len(staging) != 0 {
+		t.Errorf("staging file not clean: %v", staging)
+	}
+
+	// the staging file left by last run is committed on start, and the incomplete last line is dropped
+	header, _ := json.Marshal(map[string]interface{}{
+		"database": "shop",
+		"table":    "recover",
+		"column":   []map[string]interface{}{{"name": "id", "type": driver.ColumnTypeNumber}},
+	})
+	left := string(header) + "\n" + `{"event":"insert","data":{"id":1}}` + "\n" + `{"event":"ins`
+	util.Must(os.WriteFile(filepath.Join(dir, "_staging", "1-1.jsonl"), []byte(left), 0644))
+	util.Must(os.WriteFile(filepath.Join(dir, "_staging", "1-1.parquet"), []byte("broken"), 0644))
+	util.Must(egress.Init(config.EgressConfig{
+		Driver: "parquet_egress",
+		Url:    dir,
+		Options: map[string]interface{}{
+			"maxFileAge": "1s",
+		},
+	}))
+	util.Must(egress.Start())
+	defer egress.Stop()
+	if files := listFiles("recover"); len(files) != 1 {
+		t.Errorf("expect staging file left committed, got %d", len(files))
+	}
+
+	// the file is committed when reach maxFileAge
+	util.Must(egress.WriteData([]*driver.Data{newParquetTestData(11)}))
+	time.Sleep(2 * time.Second)
+	if files := listFiles("order"); len(files) != 4 {
+		t.Errorf("expect file committed after maxFileAge, got %d", len(files))
+	}
+}
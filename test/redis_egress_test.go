@@ -0,0 +1,85 @@
+package test
+
+import (
+	"github.com/alicebob/miniredis/v2"
+	"github.com/enustah/db-canal/config"
+	"github.com/enustah/db-canal/driver"
+	"github.com/enustah/db-canal/register"
+	"github.com/enustah/db-canal/util"
+	"testing"
+	"time"
+)
+
+func newRedisTestData(event driver.Event, table string, id int64, name string) *driver.Data {
+	return &driver.Data{
+		Event: event,
+		RawMap: map[string]interface{}{
+			"id":   id,
+			"name": name,
+		},
+		Table: &driver.Table{
+			Name: table,
+			Column: []*driver.Column{
+				{Name: "id", Type: driver.ColumnTypeNumber},
+				{Name: "name", Type: driver.ColumnTypeString},
+			},
+		},
+		Database: &driver.Database{Name: "test"},
+	}
+}
+
+func TestRedisEgress(t *testing.T) {
+	mr := miniredis.RunT(t)
+
+	d, err := register.RegisterGetDriver("redis_egress", driver.TypeEgress)
+	util.Must(err)
+	egress := d.(driver.EgressDriver)
+	util.Must(egress.Init(config.EgressConfig{
+		Driver: "redis_egress",
+		Url:    "redis://" + mr.Addr() + "/0",
+		Options: map[string]interface{}{
+			"tables": map[interface{}]interface{}{
+				"user": map[interface{}]interface{}{
+					"key": "user:{id}",
+					"ttl": "10m",
+				},
+				"order": map[interface{}]interface{}{
+					"key":    "order:{id}",
+					"format": "json",
+				},
+			},
+		},
+	}))
+	util.Must(egress.Start())
+	defer egress.Stop()
+
+	update := newRedisTestData(driver.EventUpdate, "user", 3, "new")
+	update.OldDataMap = map[string]interface{}{"id": int64(2), "name": "old"}
+	util.Must(egress.WriteData([]*driver.Data{
+		newRedisTestData(driver.EventInsert, "user", 1, "u1"),
+		newRedisTestData(driver.EventInsert, "user", 2, "old"),
+		update,
+		newRedisTestData(driver.EventInsert, "order", 1, "o1"),
+		newRedisTestData(driver.EventInsert, "order", 2, "o2"),
+		newRedisTestData(driver.EventDelete, "order", 2, "o2"),
+	}))
+
+	if v := mr.HGet("user:1", "name"); v != "u1" {
+		t.Errorf("user:1 name expect u1, got %s", v)
+	}
+	if ttl := mr.TTL("user:1"); ttl != 10*time.Minute {
+		t.Errorf("user:1 ttl expect 10m, got %s", ttl)
+	}
+	if mr.Exists("user:2") {
+		t.Errorf("user:2 should be removed by key change")
+	}
+	if v := mr.HGet("user:3", "name"); v != "new" {
+		t.Errorf("user:3 name expect new, got %s", v)
+	}
+	if v, _ := mr.Get("order:1"); v != `{"id":1,"name":"o1"}` {
+		t.Errorf("order:1 unexpect value %s", v)
+	}
+	if mr.Exists("order:2") {
+		t.Errorf("order:2 should be deleted")
+	}
+}
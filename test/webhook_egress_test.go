@@ -0,0 +1,80 @@
+package test
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/enustah/db-canal/config"
+	"github.com/enustah/db-canal/driver"
+	"github.com/enustah/db-canal/register"
+	"github.com/enustah/db-canal/util"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWebhookEgress(t *testing.T) {
+	var (
+		secret   = "s3cret"
+		fail     = true
+		received []map[string]interface{}
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(body)
+		if r.Header.Get("X-Signature") != "sha256="+hex.EncodeToString(mac.Sum(nil)) {
+			t.Errorf("signature not match")
+		}
+		if r.Header.Get("X-Token") != "abc" {
+			t.Errorf("custom header not set")
+		}
+		// first request fail, the driver should return error
+		if fail {
+			fail = false
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		util.Must(json.Unmarshal(body, &received))
+	}))
+	defer server.Close()
+
+	d, err := register.RegisterGetDriver("webhook_egress", driver.TypeEgress)
+	util.Must(err)
+	egress := d.(driver.EgressDriver)
+	util.Must(egress.Init(config.EgressConfig{
+		Driver: "webhook_egress",
+		Url:    server.URL,
+		Options: map[string]interface{}{
+			"secret":  secret,
+			"timeout": "5s",
+			"headers": map[interface{}]interface{}{
+				"X-Token": "abc",
+			},
+		},
+	}))
+	util.Must(egress.Start())
+	defer egress.Stop()
+
+	data := []*driver.Data{
+		{
+			Event:      driver.EventUpdate,
+			RawMap:     map[string]interface{}{"id": int64(1), "name": "new"},
+			OldDataMap: map[string]interface{}{"id": int64(1), "name": "old"},
+			Table:      &driver.Table{Name: "user"},
+			Database:   &driver.Database{Name: "test"},
+		},
+	}
+	if err = egress.WriteData(data); err == nil {
+		t.Fatalf("expect error on non 2xx response")
+	}
+	util.Must(egress.WriteData(data))
+	if len(received) != 1 || received[0]["table"] != "user" || received[0]["event"] != "update" {
+		t.Fatalf("unexpect payload %v", received)
+	}
+	if received[0]["old"].(map[string]interface{})["name"] != "old" {
+		t.Errorf("old data not send")
+	}
+}